@@ -0,0 +1,48 @@
+package distshell
+
+import (
+    "time"
+)
+
+// batchSizer decides how many hosts run at once, it is fixed at maxBatch unless SetAdaptiveBatch is used
+type batchSizer struct {
+    size int
+    adaptive bool
+    min int
+    max int
+    baseline time.Duration
+}
+
+// newBatchSizer returns the batch sizer for a run
+func (ds *DistShell) newBatchSizer() *batchSizer {
+    if ds.adaptiveMax < 1 {
+        return &batchSizer{size: ds.maxBatch}
+    }
+    return &batchSizer{size: ds.adaptiveMin, adaptive: true, min: ds.adaptiveMin, max: ds.adaptiveMax}
+}
+
+// adjust resizes an adaptive batch after a batch of ran hosts took elapsed with failed failures
+func (b *batchSizer) adjust(elapsed time.Duration, ran int, failed int) {
+    if !b.adaptive {
+        return
+    }
+    if b.baseline == 0 {
+        b.baseline = elapsed
+    }
+
+    switch {
+    case failed * 10 > ran:
+        b.size = b.size / 2
+    case elapsed > b.baseline * 2:
+        b.size = b.size - b.size / 4
+    case elapsed <= b.baseline + b.baseline / 4:
+        b.size = b.size + b.size / 2 + 1
+    }
+
+    if b.size < b.min {
+        b.size = b.min
+    }
+    if b.size > b.max {
+        b.size = b.max
+    }
+}
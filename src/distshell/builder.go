@@ -0,0 +1,52 @@
+package distshell
+
+import (
+    "fmt"
+    "time"
+)
+
+/*
+ *   The With methods configure a DistShell as a chain
+ *
+ *   ds := distshell.New(hosts).WithUser("deploy").WithPort(2222).WithTimeout(30*time.Second).WithMaxBatch(100)
+ *
+ *   They validate like their Set counterparts.  The first invalid value is kept and returned by the next run
+ *   instead of running anything, see ConfigError
+ */
+
+// WithUser is SetUser for chaining
+func (ds *DistShell) WithUser(user string) *DistShell {
+    return ds.withErr(ds.SetUser(user))
+}
+
+// WithPort is SetPort for chaining
+func (ds *DistShell) WithPort(port int) *DistShell {
+    return ds.withErr(ds.SetPort(port))
+}
+
+// WithTimeout is SetCommandTimeout for chaining
+func (ds *DistShell) WithTimeout(d time.Duration) *DistShell {
+    return ds.withErr(ds.SetCommandTimeout(d))
+}
+
+// WithMaxBatch is SetMaxBatch for chaining, n must be at least 1
+func (ds *DistShell) WithMaxBatch(n int) *DistShell {
+    if n < 1 {
+        return ds.withErr(fmt.Errorf("invalid max batch %d, expected at least 1", n))
+    }
+    ds.SetMaxBatch(n)
+    return ds
+}
+
+// ConfigError returns the first invalid value given to a With method, or nil
+func (ds *DistShell) ConfigError() error {
+    return ds.configErr
+}
+
+// withErr records the first configuration error
+func (ds *DistShell) withErr(err error) *DistShell {
+    if err != nil && ds.configErr == nil {
+        ds.configErr = err
+    }
+    return ds
+}
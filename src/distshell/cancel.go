@@ -0,0 +1,79 @@
+package distshell
+
+import (
+    "errors"
+)
+
+// ErrCancelled is returned by a run stopped with Cancel
+var ErrCancelled = errors.New("run cancelled")
+
+// Cancel stops the run in progress as if its context had been cancelled, for callers that do not pass one, such as
+// a signal handler in a command line tool.  Running commands are killed, hosts that have not started are skipped and
+// the run returns ErrCancelled with the partial results in Results.  It returns false when no run is in progress
+func (ds *DistShell) Cancel() bool {
+    ds.inflightMu.Lock()
+    defer ds.inflightMu.Unlock()
+    if ds.runCancel == nil {
+        return false
+    }
+    ds.runCancel(ErrCancelled)
+    return true
+}
+
+// SetHostTags replaces the host's tags, labels such as a tier or datacenter used to act on groups of hosts
+func (ds *DistShell) SetHostTags(h string, tags ...string) bool {
+    for i := range ds.HOSTS {
+        if ds.HOSTS[i].Name == h {
+            ds.HOSTS[i].tags = tags
+            return true
+        }
+    }
+    return false
+}
+
+// HostsWithTag returns the names of the hosts carrying tag, in host order
+func (ds *DistShell) HostsWithTag(tag string) []string {
+    names := make([]string, 0)
+    for i := range ds.HOSTS {
+        for _, t := range ds.HOSTS[i].tags {
+            if t == tag {
+                names = append(names, ds.HOSTS[i].Name)
+                break
+            }
+        }
+    }
+    return names
+}
+
+// CancelHost stops the host in the current run, killing its command if it is in flight and skipping it if it
+// has not started.  The rest of the run carries on.  It returns false when no run is in progress
+func (ds *DistShell) CancelHost(h string) bool {
+    ds.inflightMu.Lock()
+    defer ds.inflightMu.Unlock()
+    if ds.runDone == nil {
+        return false
+    }
+    ds.cancelledHosts[h] = true
+    if cancel, ok := ds.hostCancels[h]; ok {
+        cancel()
+    }
+    return true
+}
+
+// CancelTag is CancelHost for every host carrying tag and returns the number of hosts cancelled
+func (ds *DistShell) CancelTag(tag string) int {
+    cancelled := 0
+    for _, name := range ds.HostsWithTag(tag) {
+        if ds.CancelHost(name) {
+            cancelled += 1
+        }
+    }
+    return cancelled
+}
+
+// hostCancelled reports whether the host was cancelled during the current run
+func (ds *DistShell) hostCancelled(h string) bool {
+    ds.inflightMu.Lock()
+    defer ds.inflightMu.Unlock()
+    return ds.cancelledHosts[h]
+}
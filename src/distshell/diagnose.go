@@ -0,0 +1,126 @@
+package distshell
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// defaultSSHPort is the port Diagnose connects to when SetPort was not used
+const defaultSSHPort = 22
+
+// errStepSkipped marks a diagnostic step that did not run because an earlier one failed
+var errStepSkipped = errors.New("skipped, an earlier step failed")
+
+// DiagnosticStep is the outcome of one stage of Diagnose
+type DiagnosticStep struct {
+    Err error // nil when the stage succeeded
+    Duration time.Duration
+}
+
+// Diagnosis explains why a host is or is not reachable, each stage only runs if the one before it succeeded
+type Diagnosis struct {
+    Addresses []string // what the host's target resolved to
+    DNS DiagnosticStep
+    TCP DiagnosticStep // connect to the ssh port of the first address
+    SSH DiagnosticStep // running true over ssh, or the configured Transport
+    SSHOutput string // ssh's stderr, which explains authentication and host key failures
+}
+
+// Failed returns the first stage that failed, "dns", "tcp" or "ssh", or "" if the host is reachable
+func (d Diagnosis) Failed() string {
+    switch {
+    case d.DNS.Err != nil:
+        return "dns"
+    case d.TCP.Err != nil:
+        return "tcp"
+    case d.SSH.Err != nil:
+        return "ssh"
+    }
+    return ""
+}
+
+// Diagnose checks every host in stages, resolving its name, connecting to the ssh port and running true over ssh,
+// and times each stage so a problem can be placed in DNS, the network or ssh itself.  The port is the one given to
+// SetPort or 22, a Port in an ssh config file is not seen by the TCP stage.  Up to the batch size hosts are checked
+// at once and host results from Execute are not touched
+func (ds *DistShell) Diagnose() map[string]Diagnosis {
+    return ds.DiagnoseContext(context.Background())
+}
+
+// DiagnoseContext is Diagnose bound to ctx
+func (ds *DistShell) DiagnoseContext(ctx context.Context) map[string]Diagnosis {
+    SSH := ""
+    if ds.transport == nil {
+        SSH, _ = lookPath("ssh")
+    }
+    names := make([]string, len(ds.HOSTS))
+    for i := range ds.HOSTS {
+        names[i] = ds.HOSTS[i].Name
+    }
+
+    var mu sync.Mutex
+    results := make(map[string]Diagnosis)
+    ds.eachHost(names, func(name string) {
+        d := ds.diagnoseHost(ctx, SSH, name)
+        mu.Lock()
+        results[name] = d
+        mu.Unlock()
+    })
+    return results
+}
+
+// diagnoseHost runs the stages of Diagnose against one host
+func (ds *DistShell) diagnoseHost(ctx context.Context, SSH string, name string) Diagnosis {
+    ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+    defer cancel()
+    var d Diagnosis
+    target := ds.target(name)
+    // user@host targets resolve the host part
+    host := target[strings.LastIndex(target, "@")+1:]
+
+    start := time.Now()
+    d.Addresses, d.DNS.Err = net.DefaultResolver.LookupHost(ctx, host)
+    d.DNS.Duration = time.Since(start)
+    if d.DNS.Err != nil {
+        d.TCP.Err = errStepSkipped
+        d.SSH.Err = errStepSkipped
+        return d
+    }
+
+    port := ds.port
+    if port <= 0 {
+        port = defaultSSHPort
+    }
+    start = time.Now()
+    var dialer net.Dialer
+    conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(d.Addresses[0], strconv.Itoa(port)))
+    d.TCP.Duration = time.Since(start)
+    if err != nil {
+        d.TCP.Err = err
+        d.SSH.Err = errStepSkipped
+        return d
+    }
+    conn.Close()
+
+    var stderr bytes.Buffer
+    start = time.Now()
+    if ds.transport != nil {
+        d.SSH.Err = ds.transport.Run(ctx, target, []string{"true"}, io.Discard, &stderr)
+    } else if SSH == "" {
+        d.SSH.Err = errors.New("unable to find ssh in $PATH")
+    } else {
+        c := execCommandContext(ctx, SSH, append(ds.sshOptions(), target, "true")...)
+        c.Stderr = &stderr
+        d.SSH.Err = c.Run()
+    }
+    d.SSH.Duration = time.Since(start)
+    d.SSHOutput = strings.TrimSpace(stderr.String())
+    return d
+}
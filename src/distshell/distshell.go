@@ -2,10 +2,13 @@
    DistShell has two methods for manipulating command execution behavior
    
    DistShell.monitor is modified by functions EnableMonitoring and DisableMonitoring.
-   By default monitoring is enabled and will print host command status messages to stdout during execution.
+   By default monitoring is enabled and will print host command status messages to stdout, or the writer given to SetOutput, during execution.
    
    DistShell.maxBatch is modified by function SetMaxBatch.
    The default batch size is 50
+
+   Host names passed to New and AddHost may use pdsh style ranges and brace alternation,
+   for example "web[01-50].example.com" or "db{a,b,c}"
  
   USAGE EXAMPLE
     hosts := "host1.localdomain,host2.localdomain,host3.localdomain"
@@ -20,52 +23,275 @@
 package distshell
 
 import (
+    "regexp"
     "fmt"
     "os/exec"
     "errors"
     "strings"
+    "strconv"
+    "bytes"
+    "context"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "io"
+    "path"
+    "time"
     "os"
+    "net"
+    "syscall"
 )
 
+// ErrNotApproved is returned when the approval function rejects a run, nothing is executed
+var ErrNotApproved = errors.New("run was not approved")
+
+// ErrCommandNotAllowed is returned when a command's binary is not in the allowlist set by SetAllowedCommands
+var ErrCommandNotAllowed = errors.New("command is not allowed")
+
+// ErrEmptyHostname is returned for a host with an empty name, such as one left by a trailing comma in a host list
+var ErrEmptyHostname = errors.New("empty hostname")
+
+// ErrKilledBySignal is wrapped in the host error when the command was killed by a signal rather than exiting
+var ErrKilledBySignal = errors.New("killed by signal")
+
+// ErrOutputRejected is recorded as the host error when the success predicate rejects a host's result
+var ErrOutputRejected = errors.New("result rejected by success predicate")
+
+// maxSignal bounds the signal numbers read from a remote exit status of 128+N
+const maxSignal = 65
+
+// remotePIDMarker prefixes the line carrying the remote pid when pid capture is enabled
+const remotePIDMarker = "__DISTSHELL_PID__"
+
 // Contains the hosts command information
 type Host struct {
     Name string
-    Stdout []byte
+    Stdout []byte // combined stdout and stderr
+    Stderr []byte // stderr alone, kept even when output is discarded
     cmd string  // no need to export
     args []string
+    vars map[string]string
     CmdError error
+    RemotePID int // set when remote pid capture is enabled
+    OutputBytes int64 // number of bytes the command produced, counted even when output is discarded
+    SkipReason string // why the host did not run in the last run, empty when it ran
+    Attempts int // number of times the host's command was tried in the last run, more than 1 when it was retried
+    StartedAt time.Time // when the host's command was started
+    FinishedAt time.Time // when the host's command completed
+    Meta map[string]string // caller supplied data such as datacenter or role, see SetHostMeta
+    tags []string // labels used by CancelTag and HostsWithTag
+    weight int // cost of the command against SetConcurrencyBudget, 0 counts as 1
+    timeout time.Duration // overrides the global command timeout, see SetHostCommandTimeout
+    redirect string // remote file the command's stdout is written to, see SetHostOutputRedirect
+    steps []commandStep // conditional commands chained after cmd with AddCommandThen
+    StepResults []StepResult // one entry per command in the chain, in order
+    ExitCode int // exit status of the last command run, -1 if it did not exit normally
+    Signal syscall.Signal // signal that killed the last command run, 0 if it exited, see GetHostSignal
+    JSON []map[string]any // stdout parsed one object per line, see SetParseJSONLines
+    JSONErrors []string // stdout lines that could not be parsed as JSON objects
+    ConnectDuration time.Duration // time from starting ssh to the first byte back, see SetMeasureConnectTime
+    OutputChecksum string // hex SHA-256 of Stdout, see SetChecksumOutput
+    status int32 // HostStatus, accessed atomically so it can be read during a run
+}
+
+// commandStep is a command that runs only if the previous command's success matches onSuccess
+type commandStep struct {
+    cmd string
+    args []string
+    onSuccess bool
+}
+
+// StepResult is the outcome of one command in a host's chain
+type StepResult struct {
+    Command string
+    Stdout []byte
+    Err error
+    ExitCode int
+    Skipped bool // the step's condition was not met so it never ran
 }
 
 // Distshell uses static array of hosts for command execution 
+// A DistShell is not reentrant, starting a run while another is in progress on the same instance returns ErrAlreadyRunning
 type DistShell struct {
     HOSTS []Host
     monitor bool
     maxBatch int
+    failedHosts []string
+    defaultCmd string
+    defaultArgs []string
+    captureRemotePID bool
+    preHook func(h *Host)
+    postHook func(h *Host)
+    discardOutput bool
+    results []HostResult
+    history bool
+    maxHistory int
+    runHistory [][]HostResult
+    approve func(hosts []string, cmd string) bool
+    successPredicate func(h Host) bool
+    compression bool
+    failureThreshold float64
+    cmdModifier func(c *exec.Cmd)
+    inflightMu sync.Mutex
+    outMu sync.Mutex // serializes writes to the output so monitor lines never interleave
+    hostsMu sync.RWMutex // guards HOSTS against readers such as GetHostStatus while a run refreshes it
+    inflight map[string]int
+    sshConfigFile string
+    stderrTail int
+    running atomic.Bool
+    allowedCommands map[string]bool
+    retries int
+    ignoreConnectErrors bool
+    adaptiveMin int
+    adaptiveMax int
+    hostKeyPolicy string
+    metrics hostObserver
+    draining atomic.Bool
+    runDone chan struct{}
+    transport Transport
+    overallTimeout time.Duration
+    async *AsyncRun
+    scpQuiet bool
+    transferStderr func(host string, line string)
+    bindAddress string
+    out io.Writer
+    warnOnOverwrite bool
+    sharedLimiter chan struct{}
+    dedupeLines bool
+    nice *int
+    ionice []string
+    useSFTP bool
+    remoteSingleString bool
+    ringSize int
+    normalizeLineEndings bool
+    user string
+    port int
+    cmdTimeout time.Duration
+    configErr error
+    detached bool
+    resolver func(name string) string
+    hostWriters map[string]io.Writer
+    writerFactory func(host string) io.Writer
+    flushInterval time.Duration
+    maxOutputRate int
+    statusCallback func(ctx context.Context, e StatusEvent)
+    batchMode bool
+    sshExtraOptions map[string]string
+    errorOnNoHosts bool
+    measureConnect bool
+    parseJSONLines bool
+    hostCancels map[string]context.CancelFunc
+    cancelledHosts map[string]bool
+    hostRefresher func() []string
+    checksumOutput bool
+    sortFailedHosts bool
+    secrets []*regexp.Regexp
+    concurrencyBudget int
+    requestTTY bool
+    prefixOutput bool
+    runCancel context.CancelCauseFunc
+    resultBufferSize int
+    retryableExitCodes map[int]bool
+    templating bool
+    ioniceClass int // kept alongside ionice so plans can reapply them through SetIONice
+    ioniceLevel int
 }
 
 
 // Build the host list and return the DistShell struct
+// A malformed host pattern is kept as a literal hostname and a warning is written to os.Stdout, use NewFromPatterns
+// to have it reported as an error instead
 func New(hList []string) *DistShell {
-    ds := DistShell{buildHost(hList), true, 50}
+    hosts, errs := buildHost(hList)
+    ds := DistShell{HOSTS: hosts, monitor: true, maxBatch: 50, maxHistory: defaultMaxHistory, stderrTail: defaultStderrTail, scpQuiet: true, batchMode: true}
+    ds.warnPatterns(errs)
     return &ds
 }
 
+// NewFromPatterns is New but returns an error for a malformed host pattern instead of keeping it as a hostname
+func NewFromPatterns(hList []string) (*DistShell, error) {
+    if _, errs := buildHost(hList); len(errs) > 0 {
+        return nil, errs[0]
+    }
+    return New(hList), nil
+}
+
+// NewFromCommand runs a local inventory command and builds a DistShell from its output, one host per line
+// Whitespace is trimmed and blank lines are skipped.  Only stdout is read, the command's error is returned if it fails
+func NewFromCommand(c string, args ...string) (*DistShell, error) {
+    out, err := execCommand(c, args...).Output()
+    if err != nil {
+        return nil, fmt.Errorf("Failed to execute inventory command '%s': %s", joinCommand(c, args), err)
+    }
+    hList := make([]string, 0)
+    for _, line := range strings.Split(string(out), "\n") {
+        line = strings.TrimSpace(line)
+        if line != "" {
+            hList = append(hList, line)
+        }
+    }
+    return New(hList), nil
+}
+
 // Build the host list and return the DistShell struct
 func (ds *DistShell) SetupDistShell(hList []string) {
-    ds.HOSTS = buildHost(hList)
+    var errs []error
+    ds.HOSTS, errs = buildHost(hList)
+    ds.warnPatterns(errs)
     ds.EnableMonitoring()
     ds.SetMaxBatch(50)
+    ds.SetMaxHistory(defaultMaxHistory)
+    ds.SetFailureStderrTail(defaultStderrTail)
+    ds.SetSCPQuiet(true)
+    ds.SetBatchMode(true)
 }
 
 // buildHost creates a list of host objects and returns from a list of hostnames
-func buildHost(hList []string) []Host {
-    hObj := make([]Host, len(hList))
+// Range and brace patterns are expanded; a malformed pattern is kept as a literal hostname and its error returned
+// Empty and blank names are dropped
+func buildHost(hList []string) ([]Host, []error) {
+    hObj := make([]Host, 0, len(hList))
+    var errs []error
     for i := range hList {
-        h := Host{}
-        h.Name = hList[i]
-        hObj[i] = h
+        if strings.TrimSpace(hList[i]) == "" {
+            continue
+        }
+        names, err := expandHost(hList[i])
+        if err != nil {
+            errs = append(errs, err)
+            names = []string{hList[i]}
+        }
+        for n := range names {
+            h := Host{}
+            h.Name = names[n]
+            hObj = append(hObj, h)
+        }
+    }
+    return hObj, errs
+}
+
+// warnPatterns writes a warning for each host pattern that was kept as a literal hostname
+func (ds *DistShell) warnPatterns(errs []error) {
+    for i := range errs {
+        fmt.Fprintf(ds.output(), "WARN: %s, using it as a hostname\n", errs[i])
     }
-    return hObj
+}
+
+// AddHost expands the given host pattern and appends the resulting hosts to the host list
+func (ds *DistShell) AddHost(h string) error {
+    if strings.TrimSpace(h) == "" {
+        return ErrEmptyHostname
+    }
+    names, err := expandHost(h)
+    if err != nil {
+        return err
+    }
+    for i := range names {
+        host := Host{}
+        host.Name = names[i]
+        ds.HOSTS = append(ds.HOSTS, host)
+    }
+    return nil
 }
 
 // EnableMonitoring enables console output during command execution and is default behavior
@@ -78,174 +304,1113 @@ func (ds *DistShell) DisableMonitoring() {
     ds.monitor = false
 }
 
+// SetOutput sets where monitoring status lines and warnings are written.  Default is os.Stdout
+func (ds *DistShell) SetOutput(w io.Writer) {
+    ds.out = w
+}
+
+// output returns the writer for monitoring and warnings
+func (ds *DistShell) output() io.Writer {
+    if ds.out == nil {
+        return &lockedWriter{mu: &ds.outMu, w: os.Stdout}
+    }
+    return &lockedWriter{mu: &ds.outMu, w: ds.out}
+}
+
+// SetWarnOnOverwrite writes a warning to the output when AddCommand or AddCommandGlob replaces
+// a command already assigned to a host.  Default is false
+func (ds *DistShell) SetWarnOnOverwrite(warn bool) {
+    ds.warnOnOverwrite = warn
+}
+
 // setMaxBatch modifies the max number of running go routines during command execution.  Default is 50
 func (ds *DistShell) SetMaxBatch (n int) {
     ds.maxBatch = n
 }
 
+// SetAdaptiveBatch replaces the fixed maxBatch with a batch size that adapts between min and max during a run
+// The first batch runs min hosts and its duration becomes the baseline.  After each batch the size
+// halves if more than 10% of the batch failed, shrinks by a quarter if the batch took over twice the baseline,
+// and grows by half if it finished within 25% of the baseline.  Passing max < 1 restores the fixed maxBatch
+func (ds *DistShell) SetAdaptiveBatch(min, max int) {
+    if min < 1 {
+        min = 1
+    }
+    if max < min && max >= 1 {
+        max = min
+    }
+    ds.adaptiveMin = min
+    ds.adaptiveMax = max
+}
+
+// SetCaptureRemotePID records the pid of each remote command in Host.RemotePID
+// The remote command is exec'd from a child shell that first echoes its pid, the marker line is stripped from Stdout
+// The command must be a single executable with its arguments, a command containing shell operators such as && or |
+// fails on the host without running
+func (ds *DistShell) SetCaptureRemotePID(capture bool) {
+    ds.captureRemotePID = capture
+}
+
+// SetPreHook sets a function called with each host immediately before its command is run
+// Hooks run concurrently across hosts in the host's go routine, so they should only touch their own Host or thread safe externals
+func (ds *DistShell) SetPreHook(fn func(h *Host)) {
+    ds.preHook = fn
+}
+
+// SetPostHook sets a function called with each host immediately after its command completes
+// Hooks run concurrently across hosts in the host's go routine, so they should only touch their own Host or thread safe externals
+func (ds *DistShell) SetPostHook(fn func(h *Host)) {
+    ds.postHook = fn
+}
+
+// SetDiscardOutput stops storing command output in Host.Stdout while still counting it in Host.OutputBytes
+func (ds *DistShell) SetDiscardOutput(discard bool) {
+    ds.discardOutput = discard
+}
+
+// SetApprovalFunc sets a gate called once before Execute or PipeToLocal runs anything
+// fn receives every target host and the command lines they will run, one per line when hosts differ
+// If fn returns false the run returns ErrNotApproved without running any command
+func (ds *DistShell) SetApprovalFunc(fn func(hosts []string, cmd string) bool) {
+    ds.approve = fn
+}
+
+// SetSuccessPredicate overrides the exit code as the test of whether a host succeeded
+// fn is called with the host once its output is captured, CmdError still holds the exit error at that point
+// Hosts fn accepts have CmdError cleared, hosts it rejects get ErrOutputRejected if they exited cleanly
+func (ds *DistShell) SetSuccessPredicate(fn func(h Host) bool) {
+    ds.successPredicate = fn
+}
+
+// SetCompression enables ssh and scp compression with -C.  Default is off
+// Compression helps over slow WAN links but usually costs more CPU than it saves on a fast LAN
+func (ds *DistShell) SetCompression(compress bool) {
+    ds.compression = compress
+}
+
+// SetFailureThreshold aborts a run once more than percent of the completed hosts have failed
+// The rate is only checked once a handful of hosts have completed so a single early failure does not abort the run
+// In flight commands are cancelled, remaining hosts are skipped and ErrThresholdExceeded is returned.  0 disables the check
+func (ds *DistShell) SetFailureThreshold(percent float64) {
+    ds.failureThreshold = percent
+}
+
+// SetCmdModifier sets a function that may tweak each host's ssh exec.Cmd, such as Env or SysProcAttr, before it runs
+// This is an escape hatch for options the package does not expose.  Stdout and Stderr are assigned by the
+// package after fn returns so any writers set there are overwritten
+func (ds *DistShell) SetCmdModifier(fn func(c *exec.Cmd)) {
+    ds.cmdModifier = fn
+}
+
+// SetHostKeyPolicy sets ssh's StrictHostKeyChecking to "no", "yes" or "accept-new".  Default is "no"
+// accept-new learns the key of a host on first contact and verifies it on every connection after that
+func (ds *DistShell) SetHostKeyPolicy(policy string) error {
+    switch policy {
+    case "no", "yes", "accept-new":
+        ds.hostKeyPolicy = policy
+        return nil
+    }
+    return fmt.Errorf("invalid host key policy %q, expected no, yes or accept-new", policy)
+}
+
+// SetBindAddress makes ssh and scp connect from the given local IP address, an empty address restores the default
+func (ds *DistShell) SetBindAddress(addr string) error {
+    if addr != "" && net.ParseIP(addr) == nil {
+        return fmt.Errorf("invalid bind address %q, expected an IP address", addr)
+    }
+    ds.bindAddress = addr
+    return nil
+}
+
+// SetNice runs remote commands under nice -n level, level is -20 (highest priority) to 19 (lowest)
+func (ds *DistShell) SetNice(level int) error {
+    if level < -20 || level > 19 {
+        return fmt.Errorf("invalid nice level %d, expected -20 to 19", level)
+    }
+    ds.nice = &level
+    return nil
+}
+
+// SetIONice runs remote commands under ionice -c class -n level
+// class is 1 (realtime), 2 (best-effort) or 3 (idle) and level is 0 to 7, the idle class takes no level
+func (ds *DistShell) SetIONice(class, level int) error {
+    if class < 1 || class > 3 {
+        return fmt.Errorf("invalid ionice class %d, expected 1, 2 or 3", class)
+    }
+    if level < 0 || level > 7 {
+        return fmt.Errorf("invalid ionice level %d, expected 0 to 7", level)
+    }
+    ds.ioniceClass, ds.ioniceLevel = class, level
+    ds.ionice = []string{"ionice", "-c", strconv.Itoa(class)}
+    if class != 3 {
+        ds.ionice = append(ds.ionice, "-n", strconv.Itoa(level))
+    }
+    return nil
+}
+
+// priorityWrapper returns the nice and ionice words placed in front of the remote command
+// nice and ionice both exec the command so the remote pid marker still names the command itself
+func (ds *DistShell) priorityWrapper() []string {
+    wrapper := make([]string, 0)
+    if ds.nice != nil {
+        wrapper = append(wrapper, "nice", "-n", strconv.Itoa(*ds.nice))
+    }
+    return append(wrapper, ds.ionice...)
+}
+
+// SetUser sets the remote login user for ssh and scp, an empty user restores the ssh default
+func (ds *DistShell) SetUser(user string) error {
+    if strings.ContainsAny(user, " \t\n@") {
+        return fmt.Errorf("invalid user %q", user)
+    }
+    ds.user = user
+    return nil
+}
+
+// SetPort sets the remote ssh port for ssh and scp, 0 restores the ssh default
+func (ds *DistShell) SetPort(port int) error {
+    if port < 0 || port > 65535 {
+        return fmt.Errorf("invalid port %d, expected 1 to 65535", port)
+    }
+    ds.port = port
+    return nil
+}
+
+// SetCommandTimeout bounds how long each command may run on a host, 0 means no limit
+// A command that runs out of time is killed and its host fails with context.DeadlineExceeded
+func (ds *DistShell) SetCommandTimeout(d time.Duration) error {
+    if d < 0 {
+        return fmt.Errorf("invalid command timeout %s", d)
+    }
+    ds.cmdTimeout = d
+    return nil
+}
+
+// SetHostCommandTimeout overrides SetCommandTimeout for one host, such as a node known to need longer.  0 removes the
+// override so the host uses the global timeout again.  It returns false if the host is unknown or d is negative
+func (ds *DistShell) SetHostCommandTimeout(h string, d time.Duration) bool {
+    if d < 0 {
+        return false
+    }
+    for i := range ds.HOSTS {
+        if ds.HOSTS[i].Name == h {
+            ds.HOSTS[i].timeout = d
+            return true
+        }
+    }
+    return false
+}
+
+// commandTimeout returns the timeout that applies to the host's commands, 0 means no limit
+func (ds *DistShell) commandTimeout(h *Host) time.Duration {
+    if h.timeout > 0 {
+        return h.timeout
+    }
+    return ds.cmdTimeout
+}
+
+// SetStrictHostKeyChecking sets ssh's StrictHostKeyChecking to yes or no, see SetHostKeyPolicy for accept-new
+func (ds *DistShell) SetStrictHostKeyChecking(strict bool) {
+    if strict {
+        ds.hostKeyPolicy = "yes"
+    } else {
+        ds.hostKeyPolicy = "no"
+    }
+}
+
+// SetBatchMode sets ssh's BatchMode, which stops ssh prompting for passwords or passphrases.  Default is true
+func (ds *DistShell) SetBatchMode(batch bool) {
+    ds.batchMode = batch
+}
+
+// SetSSHOptions passes each key and value to ssh, scp and sftp as -o key=value
+// An option the package also sets, such as StrictHostKeyChecking, BatchMode, User or Port, is replaced by the
+// given value instead of being passed twice.  A nil map removes the options
+func (ds *DistShell) SetSSHOptions(opts map[string]string) error {
+    for key, val := range opts {
+        if key == "" || strings.ContainsAny(key, " \t\n=") || strings.ContainsAny(val, "\n") {
+            return fmt.Errorf("invalid ssh option %q=%q", key, val)
+        }
+    }
+    ds.sshExtraOptions = make(map[string]string, len(opts))
+    for key, val := range opts {
+        ds.sshExtraOptions[key] = val
+    }
+    return nil
+}
+
+// SetSSHConfigFile passes -F path to ssh and scp so an alternate ssh config file is used
+func (ds *DistShell) SetSSHConfigFile(path string) {
+    ds.sshConfigFile = path
+}
+
+// SetRetries sets how many times hosts that failed are retried once a run's first pass completes.  Default is 0
+// Retries apply to Execute as well as file transfers, a failed download's partial file is removed before it is retried
+func (ds *DistShell) SetRetries(n int) {
+    ds.retries = n
+}
+
+// SetIgnoreConnectErrors leaves hosts that fail with ssh's connection error status (255) out of the failed hosts,
+// so a best effort run returns nil when the only failures were unreachable hosts.  The host's CmdError is still set.
+// ssh cannot tell a connection failure apart from a remote command that itself exits 255
+func (ds *DistShell) SetIgnoreConnectErrors(ignore bool) {
+    ds.ignoreConnectErrors = ignore
+}
+
 // add a command to a specific host
 func (ds *DistShell) AddCommand(h string, command string, args ...string) bool {
+    if !ds.commandAllowed(command) {
+        return false
+    }
     for i := range ds.HOSTS {
         if ds.HOSTS[i].Name == h {
-            ds.HOSTS[i].cmd = command
-            ds.HOSTS[i].args = args
+            ds.assignCommand(&ds.HOSTS[i], command, args)
             return true
         }
     }
     return false // if we made it here then this function failed
 }
 
-// Execute command string defined by all hosts and return comma delimited string of hosts that failed 
-func (ds *DistShell) Execute() error {
-    cmdStatus := make(chan string, ds.maxBatch)
-    runningCount := 0
-    TotalCmdsRun := 0
-    TotalHosts := len(ds.HOSTS)
+// AddCommandWeighted is AddCommand with the command's cost against SetConcurrencyBudget, such as 10 for a checksum scan
+// next to 1 for an echo.  Weights below 1 count as 1
+func (ds *DistShell) AddCommandWeighted(h string, weight int, command string, args ...string) bool {
+    if !ds.AddCommand(h, command, args...) {
+        return false
+    }
     for i := range ds.HOSTS {
-        go runCMD(&ds.HOSTS[i], cmdStatus)
-        runningCount += 1
-        TotalCmdsRun += 1
-        
-        // we filled the batch or there are no more commands to run
-        // so grab status for all running commands before
-        if runningCount >= ds.maxBatch || TotalCmdsRun >= TotalHosts {
-            for c := 0; c < runningCount; c++ {
-                s := <-cmdStatus
-                if ds.monitor {
-                    fmt.Println(s)
-                }
+        if ds.HOSTS[i].Name == h {
+            ds.HOSTS[i].weight = weight
+            break
+        }
+    }
+    return true
+}
+
+// cost returns the host's command weight
+func (h *Host) cost() int {
+    if h.weight < 1 {
+        return 1
+    }
+    return h.weight
+}
+
+// SetHostArgs replaces the arguments of the command already assigned to the host
+// It returns false if the host is unknown or has no command of its own
+func (ds *DistShell) SetHostArgs(h string, args ...string) bool {
+    for i := range ds.HOSTS {
+        if ds.HOSTS[i].Name == h {
+            if ds.HOSTS[i].cmd == "" {
+                return false
             }
-            runningCount = 0
+            ds.HOSTS[i].args = args
+            return true
         }
     }
-    
-    // check for errors
-    failedHosts := ""
+    return false
+}
+
+// GetHostCommand returns the command and arguments the host will run, including the default command
+// An unknown host returns an empty command
+func (ds *DistShell) GetHostCommand(h string) (string, []string) {
     for i := range ds.HOSTS {
-        if ds.HOSTS[i].CmdError != nil {
-            failedHosts += ds.HOSTS[i].Name + ","   
+        if ds.HOSTS[i].Name == h {
+            cmd, args := ds.hostCommand(&ds.HOSTS[i])
+            argsCopy := make([]string, len(args))
+            copy(argsCopy, args)
+            return cmd, argsCopy
         }
     }
-    if failedHosts != "" {
-        // trim the last comma and return comma delimited list of failed hosts
-        failedHosts = strings.TrimRight(failedHosts, ",")
-        return errors.New(failedHosts)
+    return "", nil
+}
+
+// AddCommandGlob assigns the command to every host whose name matches pattern using path.Match syntax
+// and returns the number of hosts matched.  A malformed pattern or a disallowed command matches nothing
+func (ds *DistShell) AddCommandGlob(pattern string, command string, args ...string) int {
+    if !ds.commandAllowed(command) {
+        return 0
     }
-    
-    return nil
+    hosts := ds.matchHosts(pattern)
+    for i := range hosts {
+        ds.assignCommand(hosts[i], command, args)
+    }
+    return len(hosts)
 }
 
-// ExecuteAll adds the given command to all hosts and executes.
-func (ds *DistShell) ExecuteAll(cmd string, args ...string) error {
+// assignCommand sets the host's command, dropping any chained steps
+func (ds *DistShell) assignCommand(h *Host, command string, args []string) {
+    if ds.warnOnOverwrite && h.cmd != "" {
+        fmt.Fprintf(ds.output(), "WARN: host %s command '%s' replaced by '%s'\n", h.Name, ds.mask(joinCommand(h.cmd, h.args)), ds.mask(joinCommand(command, args)))
+    }
+    h.cmd = command
+    h.args = args
+    h.weight = 0
+    h.steps = nil
+}
+
+// matchHosts returns the hosts whose name matches the path.Match pattern
+func (ds *DistShell) matchHosts(pattern string) []*Host {
+    hosts := make([]*Host, 0)
     for i := range ds.HOSTS {
-        ds.AddCommand(ds.HOSTS[i].Name, cmd, args...)
+        if ok, err := path.Match(pattern, ds.HOSTS[i].Name); err == nil && ok {
+            hosts = append(hosts, &ds.HOSTS[i])
+        }
     }
-    if err := ds.Execute(); err != nil { return err }
-    return nil
+    return hosts
 }
 
-/* 
- *   GetFile will download a given file from remote node into specified dir
- *   filestring = /path/to/file
- *   destination = /path/to/destination/[dir|file]
- */
-func (ds *DistShell) GetFile(filestring string, destination string) error {
-    cmdStatus := make(chan string, ds.maxBatch)
-    runningCount := 0
-    TotalCmdsRun := 0
-    TotalHosts := len(ds.HOSTS)
-    
-    SCP, lookupErr := exec.LookPath("scp")
-    if lookupErr != nil {
-        fmt.Printf("Unable to find scp in $PATH\n")
-        os.Exit(1)
+// SetAllowedCommands restricts the commands that may be run to the given binaries, matched on base name
+// AddCommand refuses other commands and Execute returns ErrCommandNotAllowed without running anything
+// if any target host would run one.  An empty list removes the restriction
+// While the list is set the command and each argument are quoted for the remote shell so arguments cannot chain
+// further commands, pass every argument separately, a command with arguments embedded in it is refused.  Commands
+// sent as one shell string, with SetRemoteCommandAsSingleString or PipeToLocal, are refused if they contain shell
+// metacharacters
+func (ds *DistShell) SetAllowedCommands(cmds []string) {
+    ds.allowedCommands = nil
+    if len(cmds) == 0 {
+        return
+    }
+    ds.allowedCommands = make(map[string]bool)
+    for i := range cmds {
+        ds.allowedCommands[path.Base(cmds[i])] = true
+    }
+}
+
+// shellOperators are the characters that join or group commands in a shell, which exec cannot run
+const shellOperators = ";&|()\n"
+
+// shellMetaChars are the characters that let a shell string run more than the command it names
+const shellMetaChars = ";&|`$<>()\\\n\r'\""
+
+// commandAllowed reports whether command may be run as a host command under the allowlist
+// The command is quoted as one word, so unless it is sent as a single shell string it must be the binary alone
+func (ds *DistShell) commandAllowed(command string) bool {
+    if ds.allowedCommands != nil && !ds.remoteSingleString && strings.ContainsAny(strings.TrimSpace(command), " \t\n\r\v\f") {
+        return false
     }
+    return ds.binaryAllowed(command)
+}
 
+// binaryAllowed reports whether the binary of command is in the allowlist
+func (ds *DistShell) binaryAllowed(command string) bool {
+    if ds.allowedCommands == nil {
+        return true
+    }
+    fields := strings.Fields(command)
+    if len(fields) == 0 {
+        return true // nothing to run, the missing command is reported at execution
+    }
+    return ds.allowedCommands[path.Base(fields[0])]
+}
+
+// AddCommandThen chains a command after the host's existing commands
+// It runs only if the previous command succeeded when onSuccess is true, or only if it failed when onSuccess is false,
+// like && and || in a shell.  A skipped step ends the chain.  AddCommand replaces the whole chain
+func (ds *DistShell) AddCommandThen(h string, command string, args []string, onSuccess bool) bool {
+    if !ds.commandAllowed(command) {
+        return false
+    }
     for i := range ds.HOSTS {
-        go func(hostname *Host, cmdStatus chan string){
-            remoteFile := hostname.Name + ":" + filestring
-            cmdout, cmderr := RunCMD(SCP, "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=no", remoteFile, destination)
-            if cmderr != nil {
-                hostname.CmdError = cmderr
-                cmdStatus <-  fmt.Sprintf("%s: ERROR %s: %s", hostname.Name, cmdout, cmderr)
-            } else {
-                cmdStatus <- fmt.Sprintf("%s: SUCCESS", hostname.Name)
-            }
-        }(&ds.HOSTS[i], cmdStatus)
-        runningCount += 1
-        TotalCmdsRun += 1
-        
-        // we filled the batch or there are no more commands to run
-        // so grab status for all running commands before
-        if runningCount >= ds.maxBatch || TotalCmdsRun >= TotalHosts {
-            for c := 0; c < runningCount; c++ {
-                s := <-cmdStatus
-                if ds.monitor {
-                    fmt.Println(s)
-                }
-            }
-            runningCount = 0
+        if ds.HOSTS[i].Name == h {
+            ds.HOSTS[i].steps = append(ds.HOSTS[i].steps, commandStep{command, args, onSuccess})
+            return true
         }
     }
-    
-    // check for errors
-    failedHosts := ""
+    return false
+}
+
+// AddArgsMap assigns the same command to every host in argsByHost, each with its own args
+// Returns the sorted hostnames that could not be assigned, as AddCommandMap does
+func (ds *DistShell) AddArgsMap(cmd string, argsByHost map[string][]string) []string {
+    unknown := make([]string, 0)
+    for h, args := range argsByHost {
+        if !ds.AddCommand(h, cmd, args...) {
+            unknown = append(unknown, h)
+        }
+    }
+    sort.Strings(unknown)
+    return unknown
+}
+
+// AddCommandMap assigns commands from a map of hostname to command followed by its args
+// Entries with an empty slice are ignored.  Returns the sorted hostnames that could not be assigned,
+// either because they are not in the host list or their command is not allowed
+func (ds *DistShell) AddCommandMap(m map[string][]string) []string {
+    unknown := make([]string, 0)
+    for h, command := range m {
+        if len(command) == 0 {
+            continue
+        }
+        if !ds.AddCommand(h, command[0], command[1:]...) {
+            unknown = append(unknown, h)
+        }
+    }
+    sort.Strings(unknown)
+    return unknown
+}
+
+// SetDefaultCommand sets the command run on any host that has not been given one with AddCommand
+func (ds *DistShell) SetDefaultCommand(command string, args ...string) {
+    ds.defaultCmd = command
+    ds.defaultArgs = args
+}
+
+// hostCommand returns the command the given host will run, falling back to the default command
+func (ds *DistShell) hostCommand(h *Host) (string, []string) {
+    if h.cmd == "" {
+        return ds.defaultCmd, ds.defaultArgs
+    }
+    return h.cmd, h.args
+}
+
+// Execute command string defined by all hosts and return comma delimited string of hosts that failed 
+func (ds *DistShell) Execute() error {
+    return ds.ExecuteContext(context.Background())
+}
+
+// ExecuteContext is Execute bound to ctx
+// Cancelling ctx kills in flight commands and skips hosts that have not started, ctx.Err() is returned
+func (ds *DistShell) ExecuteContext(ctx context.Context) error {
+    return ds.execute(ctx, ds.allHosts())
+}
+
+// AsyncRun is the handle returned by ExecuteAsync
+type AsyncRun struct {
+    done chan struct{}
+    err error
+}
+
+// Wait blocks until the run completes and returns its error
+func (r *AsyncRun) Wait() error {
+    <-r.done
+    return r.err
+}
+
+// ExecuteAsync runs Execute in a background go routine and returns immediately
+// onComplete, if not nil, is called with the run's error when it finishes and before Wait returns.
+// Only one run may be in progress per DistShell, a second call reports ErrAlreadyRunning
+func (ds *DistShell) ExecuteAsync(onComplete func(err error)) *AsyncRun {
+    r := &AsyncRun{done: make(chan struct{})}
+    ds.inflightMu.Lock()
+    busy := ds.running.Load()
+    if ds.async != nil {
+        select {
+        case <-ds.async.done:
+        default:
+            busy = true
+        }
+    }
+    if !busy {
+        ds.async = r
+    }
+    ds.inflightMu.Unlock()
+    if busy {
+        r.err = ErrAlreadyRunning
+        if onComplete != nil {
+            onComplete(r.err)
+        }
+        close(r.done)
+        return r
+    }
+    go func() {
+        defer close(r.done)
+        r.err = ds.Execute()
+        if onComplete != nil {
+            onComplete(r.err)
+        }
+    }()
+    return r
+}
+
+// ExecuteShard runs the commands only on hosts whose index modulo shardCount equals shardIndex
+// This lets parallel workers split one inventory deterministically, the returned error covers the shard only
+func (ds *DistShell) ExecuteShard(shardIndex, shardCount int) error {
+    if shardCount < 1 || shardIndex < 0 || shardIndex >= shardCount {
+        return fmt.Errorf("invalid shard %d of %d", shardIndex, shardCount)
+    }
+    hosts := make([]*Host, 0)
     for i := range ds.HOSTS {
-        if ds.HOSTS[i].CmdError != nil {
-            failedHosts += ds.HOSTS[i].Name + ","   
+        if i % shardCount == shardIndex {
+            hosts = append(hosts, &ds.HOSTS[i])
+        }
+    }
+    return ds.execute(context.Background(), hosts)
+}
+
+// execute asks for approval and then runs each host's command
+func (ds *DistShell) execute(ctx context.Context, hosts []*Host) error {
+    for i := range hosts {
+        command, _ := ds.hostCommand(hosts[i])
+        if !ds.commandAllowed(command) {
+            return fmt.Errorf("%w: %s on host %s", ErrCommandNotAllowed, ds.mask(command), hosts[i].Name)
+        }
+        for _, step := range hosts[i].steps {
+            if !ds.commandAllowed(step.cmd) {
+                return fmt.Errorf("%w: %s on host %s", ErrCommandNotAllowed, ds.mask(step.cmd), hosts[i].Name)
+            }
         }
     }
-    if failedHosts != "" {
-        // trim the last comma and return comma delimited list of failed hosts
-        failedHosts = strings.TrimRight(failedHosts, ",")
-        return errors.New(failedHosts)
+    if !ds.approved(hosts, ds.describeCommands(hosts)) {
+        return ErrNotApproved
     }
-    return nil
+    return ds.runBatch(ctx, hosts, ds.runCMD)
+}
+
+// approved asks the approval function, if one is set, whether commands may run on hosts
+func (ds *DistShell) approved(hosts []*Host, commands string) bool {
+    if ds.approve == nil {
+        return true
+    }
+    names := make([]string, len(hosts))
+    for i := range hosts {
+        names[i] = hosts[i].Name
+    }
+    return ds.approve(names, commands)
+}
+
+// describeCommands returns the distinct command lines the given hosts will run, one per line
+func (ds *DistShell) describeCommands(hosts []*Host) string {
+    seen := make(map[string]bool)
+    lines := make([]string, 0)
+    for i := range hosts {
+        line := ds.commandLine(hosts[i])
+        if !seen[line] {
+            seen[line] = true
+            lines = append(lines, line)
+        }
+    }
+    return strings.Join(lines, "\n")
+}
+
+// commandLine returns the command and args the host will run joined by spaces
+// Chained steps are appended with && or || to show when they run
+func (ds *DistShell) commandLine(h *Host) string {
+    command, args := ds.hostCommand(h)
+    line := joinCommand(command, args)
+    for _, step := range h.steps {
+        if step.onSuccess {
+            line += " && " + joinCommand(step.cmd, step.args)
+        } else {
+            line += " || " + joinCommand(step.cmd, step.args)
+        }
+    }
+    return ds.mask(line)
+}
+
+// joinCommand joins a command and its args with spaces the way ssh does
+func joinCommand(command string, args []string) string {
+    return strings.TrimSpace(command + " " + strings.Join(args, " "))
+}
+
+// allHosts returns a pointer to every host in the host list
+func (ds *DistShell) allHosts() []*Host {
+    hosts := make([]*Host, len(ds.HOSTS))
+    for i := range ds.HOSTS {
+        hosts[i] = &ds.HOSTS[i]
+    }
+    return hosts
+}
+
+// ExecuteAll adds the given command to all hosts and executes.
+func (ds *DistShell) ExecuteAll(cmd string, args ...string) error {
+    if !ds.commandAllowed(cmd) {
+        return ErrCommandNotAllowed
+    }
+    return ds.claimRun(context.Background(), func(ctx context.Context) error {
+        for i := range ds.HOSTS {
+            ds.AddCommand(ds.HOSTS[i].Name, cmd, args...)
+        }
+        return ds.execute(ctx, ds.allHosts())
+    })
 }
 
-// Execute the command on the given remote host
-func runCMD(h *Host, ch chan string ) {
+// Execute the command on the given remote host and return the status message
+// Steps chained with AddCommandThen run afterwards, the host's output and error are those of the last step run
+func (ds *DistShell) runCMD(ctx context.Context, h *Host) string {
     
-    if h.cmd == "" {
-        ch <- fmt.Sprintf("ERROR: host %s has no available command to execute", h.Name)
+    if strings.TrimSpace(h.Name) == "" {
+        h.CmdError = ErrEmptyHostname
+        return "ERROR: skipping a host with an empty name"
+    }
+    command, args := ds.hostCommand(h)
+    if command == "" {
         h.CmdError = errors.New("no available command to execute")
+        return fmt.Sprintf("ERROR: host %s has no available command to execute", h.Name)
     }
 
-    SSH, lookupErr := exec.LookPath("ssh")
-    if lookupErr != nil {
-        fmt.Printf("Unable to find ssh in $PATH\n")
-        os.Exit(1)
+    SSH := ""
+    if ds.transport == nil {
+        var lookupErr error
+        SSH, lookupErr = lookPath("ssh")
+        if lookupErr != nil {
+            fmt.Printf("Unable to find ssh in $PATH\n")
+            os.Exit(1)
+        }
     }
     
-    // build []string and ship it with exec.Command
-    cmdArgs := make([]string, 0)
-    cmdArgs = append(cmdArgs, "-o")
-    cmdArgs = append(cmdArgs, "StrictHostKeyChecking=no")
-    cmdArgs = append(cmdArgs, "-o")
-    cmdArgs = append(cmdArgs, "BatchMode=yes")
-    cmdArgs = append(cmdArgs, h.Name)
-    cmdArgs = append(cmdArgs, h.cmd)
-    for i := range h.args {
-        cmdArgs = append(cmdArgs, h.args[i])
-    }
-    out, err := exec.Command(SSH, cmdArgs...).CombinedOutput()
+    if ds.preHook != nil {
+        ds.preHook(h)
+    }
+    h.StepResults = make([]StepResult, 0, len(h.steps) + 1)
+    h.StartedAt = time.Now()
+    ds.runStep(ctx, SSH, h, command, args)
+    for i := range h.steps {
+        step := h.steps[i]
+        if (h.CmdError == nil) != step.onSuccess {
+            // the condition failed so this step and everything chained after it is skipped
+            for _, skipped := range h.steps[i:] {
+                h.StepResults = append(h.StepResults, StepResult{Command: ds.mask(joinCommand(skipped.cmd, skipped.args)), Skipped: true})
+            }
+            break
+        }
+        ds.runStep(ctx, SSH, h, step.cmd, step.args)
+    }
+    h.FinishedAt = time.Now()
+
+    if ds.successPredicate != nil {
+        if ds.successPredicate(*h) {
+            h.CmdError = nil
+        } else if h.CmdError == nil {
+            h.CmdError = ErrOutputRejected
+        }
+    }
+    if ds.postHook != nil {
+        ds.postHook(h)
+    }
+    if h.CmdError != nil {
+        return fmt.Sprintf("ERROR: Failed to exec command on host %s: %s", h.Name, h.CmdError)
+    }
+    
+    return fmt.Sprintf("INFO: completed running command on host %s", h.Name)
+}
+
+// runStep runs one command on the host over ssh or the configured Transport, storing its output and error on the host and in StepResults
+func (ds *DistShell) runStep(ctx context.Context, SSH string, h *Host, command string, args []string) {
+    result := StepResult{Command: ds.mask(joinCommand(command, args))}
+    defer func() {
+        h.StepResults = append(h.StepResults, result)
+    }()
+    if timeout := ds.commandTimeout(h); timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, timeout)
+        defer cancel()
+    }
+
+    var err error
+    if ds.templating || h.vars != nil {
+        command, args, err = expandCommand(h, command, args)
+    }
+    var remote []string
+    if err == nil {
+        remote, err = ds.remoteCommand(h, command, args)
+    }
     if err != nil {
-        ch <- fmt.Sprintf("ERROR: Failed to exec command on host %s: %s", h.Name, err)
-        h.Stdout = out
+        h.Stdout = nil
+        h.Stderr = nil
         h.CmdError = err
+        h.ExitCode = -1
+        result.Err = err
+        result.ExitCode = -1
         return
     }
-    h.Stdout = out    
-    
-    ch <- fmt.Sprintf("INFO: completed running command on host %s", h.Name)
-    return
+
+    capture := &outputCapture{discard: ds.discardOutput, ring: ds.ringSize}
+    stderr := &outputCapture{ring: ds.ringSize}
+    var stdoutW io.Writer = capture
+    var stderrW io.Writer = io.MultiWriter(capture, stderr)
+    if w := ds.hostOutputWriter(h.Name); w != nil {
+        stdoutW = io.MultiWriter(capture, w)
+        stderrW = io.MultiWriter(capture, stderr, w)
+    }
+    var prefix *prefixWriter
+    if ds.monitor && ds.prefixOutput {
+        prefix = &prefixWriter{prefix: h.Name + ": ", w: ds.output()}
+        stdoutW = io.MultiWriter(stdoutW, prefix)
+        stderrW = io.MultiWriter(stderrW, prefix)
+    }
+    var marker *markerWriter
+    if ds.captureRemotePID || ds.measureConnect {
+        // the marker line is taken off stdout before anything else sees or counts it
+        marker = &markerWriter{w: stdoutW}
+        stdoutW = marker
+    }
+    if ds.maxOutputRate > 0 {
+        // stdout and stderr share one budget so a host cannot double its rate through stderr
+        bucket := newTokenBucket(ds.maxOutputRate)
+        stdoutW = &rateLimitedWriter{ctx: ctx, w: stdoutW, bucket: bucket}
+        stderrW = &rateLimitedWriter{ctx: ctx, w: stderrW, bucket: bucket}
+    }
+    var firstByte *firstByteWriter
+    if ds.measureConnect {
+        firstByte = &firstByteWriter{}
+        stdoutW = io.MultiWriter(firstByte, stdoutW)
+        stderrW = io.MultiWriter(firstByte, stderrW)
+    }
+    started := time.Now()
+    if ds.transport != nil {
+        err = ds.transport.Run(ctx, ds.target(h.Name), remote, stdoutW, stderrW)
+    } else {
+        sshArgs := ds.sshOptions()
+        if ds.requestTTY {
+            sshArgs = append(sshArgs, "-tt")
+        }
+        sshArgs = append(sshArgs, ds.target(h.Name))
+        c := execCommandContext(ctx, SSH, append(sshArgs, remote...)...)
+        if ds.cmdModifier != nil {
+            ds.cmdModifier(c)
+        }
+        c.Stdout = stdoutW
+        c.Stderr = stderrW
+        err = c.Run()
+    }
+    if marker != nil {
+        marker.flush()
+        if ds.captureRemotePID {
+            h.RemotePID = marker.pid
+        }
+    }
+    if prefix != nil {
+        prefix.flush()
+    }
+    if firstByte != nil {
+        h.ConnectDuration = firstByte.since(started)
+    }
+    out := capture.Bytes()
+    h.OutputBytes = capture.n
+    errOut := stderr.Bytes()
+    if ds.normalizeLineEndings {
+        out = bytes.Replace(out, []byte("\r\n"), []byte("\n"), -1)
+        errOut = bytes.Replace(errOut, []byte("\r\n"), []byte("\n"), -1)
+    }
+    if ds.dedupeLines {
+        out = dedupeLines(out)
+    }
+    h.Stdout = out
+    h.Stderr = errOut
+    if ds.parseJSONLines {
+        h.JSON, h.JSONErrors = parseJSONLines(out)
+    }
+    if ds.checksumOutput {
+        h.OutputChecksum = checksum(out)
+    }
+    h.CmdError = err
+    h.ExitCode = exitCode(err)
+    h.Signal = 0
+    if err != nil && ctx.Err() != nil {
+        h.CmdError = ctx.Err()
+    } else if sig, ok := exitSignal(err); ok {
+        h.Signal = sig
+        h.CmdError = fmt.Errorf("%w %d (%s)", ErrKilledBySignal, int(sig), sig)
+    }
+    result.Stdout = h.Stdout
+    result.Err = h.CmdError
+    result.ExitCode = h.ExitCode
+}
+
+// remoteCommand builds the words ssh sends to the remote shell
+func (ds *DistShell) remoteCommand(h *Host, command string, args []string) ([]string, error) {
+    if ds.remoteSingleString {
+        if len(args) > 0 {
+            return nil, errors.New("a remote command passed as a single string takes no arguments")
+        }
+        if ds.allowedCommands != nil && strings.ContainsAny(command, shellMetaChars) {
+            return nil, fmt.Errorf("%w: shell metacharacters in %s", ErrCommandNotAllowed, ds.mask(command))
+        }
+        return []string{command}, nil
+    }
+    if ds.allowedCommands != nil {
+        // the allowlist only vouches for the binary, keep the remote shell from reading anything else as syntax
+        quoted := make([]string, len(args))
+        for i := range args {
+            quoted[i] = shellQuote(args[i])
+        }
+        command, args = shellQuote(command), quoted
+    }
+    if ds.detached {
+        return ds.detachedCommand(h, command, args), nil
+    }
+    // exec only runs a single executable, arguments quoted under an allowlist cannot hold operators
+    if ds.captureRemotePID && ds.allowedCommands == nil && strings.ContainsAny(joinCommand(command, args), shellOperators) {
+        return nil, fmt.Errorf("remote pid capture needs a single command, %s contains shell operators", ds.mask(joinCommand(command, args)))
+    }
+    remote := make([]string, 0, len(args) + 8)
+    // the marker is also the first byte back once connected when connect time is measured
+    if ds.captureRemotePID {
+        // a child shell execs the command so the $$ it echoes is the pid of the command itself, fd 3 carries the
+        // marker past a redirect of the command's stdout
+        remote = append(remote, "sh", "-c", shellQuote("echo " + remotePIDMarker + "$$ >&3; exec 3>&-; exec \"$@\""), "sh")
+    } else if ds.measureConnect {
+        // without exec so compound commands such as cd /tmp && ls still run
+        remote = append(remote, "echo", remotePIDMarker + "$$;")
+    }
+    remote = append(remote, ds.priorityWrapper()...)
+    remote = append(remote, command)
+    for i := range args {
+        remote = append(remote, args[i])
+    }
+    if ds.captureRemotePID {
+        remote = append(remote, "3>&1")
+    }
+    if h.redirect != "" {
+        remote = append(remote, ">", shellQuote(h.redirect))
+    }
+    if ds.transport == nil {
+        // keep the remote shell as the command's parent, otherwise it execs the command and sshd turns a command
+        // killed by a signal into exit status 255, the same as a connection error
+        remote = append(remote, "\nexit", "$?")
+    }
+    return remote, nil
+}
+
+// detachedCommand starts the command in the background under nohup so ssh returns as soon as it is launched
+// The pid marker reports the background process' pid via $!
+func (ds *DistShell) detachedCommand(h *Host, command string, args []string) []string {
+    remote := []string{"nohup"}
+    remote = append(remote, ds.priorityWrapper()...)
+    remote = append(remote, command)
+    remote = append(remote, args...)
+    if h.redirect != "" {
+        remote = append(remote, ">", shellQuote(h.redirect))
+    } else {
+        remote = append(remote, ">/dev/null")
+    }
+    remote = append(remote, "2>&1", "&")
+    if ds.captureRemotePID {
+        remote = append(remote, "echo", remotePIDMarker + "$!")
+    }
+    return remote
+}
+
+// SetHostOutputRedirect writes the host's command stdout to remotePath on the host instead of returning it,
+// so very large output stays on the node and only stderr and the exit status come back.  An empty path removes
+// the redirect.  It is not applied with SetRemoteCommandAsSingleString
+func (ds *DistShell) SetHostOutputRedirect(h string, remotePath string) bool {
+    for i := range ds.HOSTS {
+        if ds.HOSTS[i].Name == h {
+            ds.HOSTS[i].redirect = remotePath
+            return true
+        }
+    }
+    return false
+}
+
+// SetDetached starts remote commands in the background with nohup and discards their output, so a host
+// completes once its command is launched.  This suits starting daemons, only the launch is reported
+func (ds *DistShell) SetDetached(detached bool) {
+    ds.detached = detached
+}
+
+// SetRemoteCommandAsSingleString passes each host's command to ssh as one pre-assembled string that the remote
+// shell runs verbatim.  Commands must then have no arguments, and remote pid capture, nice and ionice are not applied
+func (ds *DistShell) SetRemoteCommandAsSingleString(single bool) {
+    ds.remoteSingleString = single
+}
+
+// exitSignal returns the signal carried by err when the process was killed by one, either the local process
+// itself or the remote command, which the remote shell reports as exit status 128+N
+func exitSignal(err error) (syscall.Signal, bool) {
+    var exitErr *exec.ExitError
+    if errors.As(err, &exitErr) {
+        if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+            return status.Signal(), true
+        }
+    }
+    if code := exitCode(err); code > 128 && code - 128 < maxSignal {
+        return syscall.Signal(code - 128), true
+    }
+    return 0, false
+}
+
+// exitCode returns the exit status carried by err, 0 for nil and -1 when the process did not exit normally
+func exitCode(err error) int {
+    if err == nil {
+        return 0
+    }
+    // *exec.ExitError and the errors of a Transport report their status through ExitCode
+    var exitErr interface{ ExitCode() int }
+    if errors.As(err, &exitErr) {
+        return exitErr.ExitCode()
+    }
+    return -1
+}
+
+// sshArgs returns the ssh options followed by the target for the given host
+func (ds *DistShell) sshArgs(h *Host) []string {
+    cmdArgs := ds.sshOptions()
+    cmdArgs = append(cmdArgs, ds.target(h.Name))
+    return cmdArgs
+}
+
+/*
+ *   SetRequestTTY passes -tt to ssh so the remote command runs under a pseudo terminal, for tools that refuse to run
+ *   or behave differently when they are not attached to one.  Default is false
+ *   The terminal merges the command's stderr into its stdout so Host.Stderr stays empty, lines end in \r\n unless
+ *   SetNormalizeLineEndings is on, and tools may add colors, progress bars or prompts to the captured output.
+ *   It only applies to the host commands run by Execute over ssh, not to PipeToLocal, Tail, file transfers or a
+ *   custom Transport
+ */
+func (ds *DistShell) SetRequestTTY(enable bool) {
+    ds.requestTTY = enable
+}
+
+// SetHostResolver sets a function that turns a host's Name into the target ssh and scp connect to,
+// such as an IP address from a static map or service catalog.  Name is still used in output and results
+// An empty result falls back to Name
+func (ds *DistShell) SetHostResolver(fn func(name string) string) {
+    ds.resolver = fn
+}
+
+// target returns the connection target for the named host
+func (ds *DistShell) target(name string) string {
+    if ds.resolver != nil {
+        if t := ds.resolver(name); t != "" {
+            return t
+        }
+    }
+    return name
+}
+
+// sshOptions returns the options shared by ssh and scp
+func (ds *DistShell) sshOptions() []string {
+    hostKeyPolicy := ds.hostKeyPolicy
+    if hostKeyPolicy == "" {
+        hostKeyPolicy = "no"
+    }
+    batchMode := "no"
+    if ds.batchMode {
+        batchMode = "yes"
+    }
+    // scp spells some ssh flags differently so the option form is used for both
+    opts := [][2]string{{"StrictHostKeyChecking", hostKeyPolicy}, {"BatchMode", batchMode}}
+    if ds.user != "" {
+        opts = append(opts, [2]string{"User", ds.user})
+    }
+    if ds.port > 0 {
+        opts = append(opts, [2]string{"Port", strconv.Itoa(ds.port)})
+    }
+    if ds.bindAddress != "" {
+        opts = append(opts, [2]string{"BindAddress", ds.bindAddress})
+    }
+
+    // ssh keeps the first value it sees for an option, so caller options replace ours rather than follow them
+    extra := make([]string, 0, len(ds.sshExtraOptions))
+    for key := range ds.sshExtraOptions {
+        extra = append(extra, key)
+    }
+    sort.Strings(extra)
+    for _, key := range extra {
+        replaced := false
+        for i := range opts {
+            if strings.EqualFold(opts[i][0], key) {
+                opts[i][1] = ds.sshExtraOptions[key]
+                replaced = true
+            }
+        }
+        if !replaced {
+            opts = append(opts, [2]string{key, ds.sshExtraOptions[key]})
+        }
+    }
+
+    cmdArgs := make([]string, 0, len(opts) * 2 + 3)
+    for i := range opts {
+        cmdArgs = append(cmdArgs, "-o", opts[i][0] + "=" + opts[i][1])
+    }
+    if ds.compression {
+        cmdArgs = append(cmdArgs, "-C")
+    }
+    if ds.sshConfigFile != "" {
+        cmdArgs = append(cmdArgs, "-F", ds.sshConfigFile)
+    }
+    return cmdArgs
+}
+
+// extractRemotePID parses the pid marker line out of the command output and returns the pid and remaining output
+func extractRemotePID(out []byte) (int, []byte) {
+    start := bytes.Index(out, []byte(remotePIDMarker))
+    if start < 0 {
+        return 0, out
+    }
+    end := bytes.IndexByte(out[start:], '\n')
+    if end < 0 {
+        end = len(out)
+    } else {
+        end += start
+    }
+    // under a pty from SetRequestTTY the marker line ends in \r\n
+    pid, err := strconv.Atoi(strings.TrimSuffix(string(out[start+len(remotePIDMarker) : end]), "\r"))
+    if err != nil {
+        return 0, out
+    }
+    if end < len(out) {
+        end++ // drop the newline as well
+    }
+    clean := make([]byte, 0, len(out)-(end-start))
+    clean = append(clean, out[:start]...)
+    clean = append(clean, out[end:]...)
+    return pid, clean
+}
+
+// markerWriter passes a command's stdout on to w without the pid marker line the remote command starts with
+type markerWriter struct {
+    w io.Writer
+    line []byte
+    done bool
+    pid int
+}
+
+func (m *markerWriter) Write(p []byte) (int, error) {
+    n := len(p)
+    if !m.done {
+        i := bytes.IndexByte(p, '\n')
+        if i < 0 {
+            m.line = append(m.line, p...)
+            // keep buffering only while the line can still be the marker
+            if !bytes.HasPrefix(m.line, []byte(remotePIDMarker)) && !bytes.HasPrefix([]byte(remotePIDMarker), m.line) {
+                return n, m.release()
+            }
+            return n, nil
+        }
+        m.line = append(m.line, p[:i+1]...)
+        p = p[i+1:]
+        if err := m.release(); err != nil {
+            return 0, err
+        }
+    }
+    if len(p) == 0 {
+        return n, nil
+    }
+    if _, err := m.w.Write(p); err != nil {
+        return 0, err
+    }
+    return n, nil
+}
+
+// release parses the buffered first line and writes whatever is not the marker to w
+func (m *markerWriter) release() error {
+    m.done = true
+    var rest []byte
+    m.pid, rest = extractRemotePID(m.line)
+    m.line = nil
+    if len(rest) == 0 {
+        return nil
+    }
+    _, err := m.w.Write(rest)
+    return err
+}
+
+// flush handles a first line that never ended in a newline
+func (m *markerWriter) flush() {
+    if !m.done {
+        m.release()
+    }
 }
 
 // print out the given hosts stdout
 func (ds *DistShell) DumpHostStdout(h string) {
     for i := range ds.HOSTS {
         if ds.HOSTS[i].Name == h {
-            fmt.Printf("Dumping output for cmd '%s' from host %s:\n%s", ds.HOSTS[i].cmd, ds.HOSTS[i].Name, ds.HOSTS[i].Stdout)
+            command, _ := ds.hostCommand(&ds.HOSTS[i])
+            fmt.Printf("Dumping output for cmd '%s' from host %s:\n%s", ds.mask(command), ds.HOSTS[i].Name, ds.HOSTS[i].Stdout)
         }
     }
 }
@@ -260,21 +1425,109 @@ func (ds *DistShell) GetHostStdout(h string) []byte {
     return []byte{'n', 'o', ' ', 'o', 'u', 't', 'p', 'u', 't'}
 }
 
-// print stdout from all hosts
+/*
+ *   GetHostSignal returns the signal that killed the host's last command, 0 if it exited or the host is unknown
+ *   Over ssh the signal is read from the remote shell's exit status of 128+N, so a command that itself exits with
+ *   such a status, like 137, is reported as killed by signal N.  The remote shell cannot tell the two apart
+ */
+func (ds *DistShell) GetHostSignal(h string) syscall.Signal {
+    for i := range ds.HOSTS {
+        if ds.HOSTS[i].Name == h {
+            return ds.HOSTS[i].Signal
+        }
+    }
+    return 0
+}
+
+// GetHostStdoutString returns the host's output as a string with invalid UTF-8 replaced by the replacement rune
+// so it can be safely serialized.  Use GetHostStdout for the exact bytes
+func (ds *DistShell) GetHostStdoutString(h string) string {
+    return strings.ToValidUTF8(string(ds.GetHostStdout(h)), "\uFFFD")
+}
+
+// SetHostMeta attaches a key and value to the given host, available as Host.Meta, HostResult.Meta and {{.Meta.key}} in templates
+func (ds *DistShell) SetHostMeta(h string, key string, val string) bool {
+    for i := range ds.HOSTS {
+        if ds.HOSTS[i].Name == h {
+            if ds.HOSTS[i].Meta == nil {
+                ds.HOSTS[i].Meta = make(map[string]string)
+            }
+            ds.HOSTS[i].Meta[key] = val
+            return true
+        }
+    }
+    return false
+}
+
+// GetHostTimes returns when the given host's command started and finished
+func (ds *DistShell) GetHostTimes(h string) (time.Time, time.Time) {
+    for i := range ds.HOSTS {
+        if ds.HOSTS[i].Name == h {
+            return ds.HOSTS[i].StartedAt, ds.HOSTS[i].FinishedAt
+        }
+    }
+    return time.Time{}, time.Time{}
+}
+
+// DumpHostsMatching prints stdout from every host whose name matches the path.Match pattern, in host order,
+// as DumpAllStdout does.  Returns the number of hosts matched and says so when there are none
+func (ds *DistShell) DumpHostsMatching(pattern string) int {
+    hosts := ds.matchHosts(pattern)
+    if len(hosts) == 0 {
+        fmt.Printf("No hosts match pattern %s\n", pattern)
+    }
+    for i := range hosts {
+        fmt.Printf("Dumping output for host: %s %s\n%s", hosts[i].Name, ds.hostStatusTag(hosts[i]), hosts[i].Stdout)
+    }
+    return len(hosts)
+}
+
+// print stdout from all hosts, each headed by the exit status or failure of the host
 func (ds *DistShell) DumpAllStdout() {
     for i := range ds.HOSTS {
-        fmt.Printf("Dumping output for host: %s\n%s", ds.HOSTS[i].Name, ds.HOSTS[i].Stdout)
+        fmt.Printf("Dumping output for host: %s %s\n%s", ds.HOSTS[i].Name, ds.hostStatusTag(&ds.HOSTS[i]), ds.HOSTS[i].Stdout)
+    }
+}
+
+// hostStatusTag describes how the host's last run ended, e.g. "[exit 0]" or "[FAILED: exit status 1]"
+// The error detail is only included while monitoring is enabled
+func (ds *DistShell) hostStatusTag(h *Host) string {
+    if h.SkipReason != "" {
+        return "[skipped: " + h.SkipReason + "]"
+    }
+    if h.CmdError == nil {
+        return fmt.Sprintf("[exit %d]", h.ExitCode)
     }
+    if ds.monitor {
+        return fmt.Sprintf("[FAILED: %s]", h.CmdError)
+    }
+    return "[FAILED]"
+}
+
+// RunOne runs a command on a single host with the default options and returns its output and error
+func RunOne(host string, cmd string, args ...string) ([]byte, error) {
+    ds := New([]string{host})
+    if len(ds.HOSTS) != 1 {
+        return nil, fmt.Errorf("RunOne needs a single host, %q expands to %d", host, len(ds.HOSTS))
+    }
+    ds.AddCommand(ds.HOSTS[0].Name, cmd, args...)
+    ds.Execute()
+    return ds.HOSTS[0].Stdout, ds.HOSTS[0].CmdError
 }
 
 // Execute comamnd and return byte output and error
 func RunCMD(c string, args ...string) ([]byte, error) {
+    return runCMDContext(context.Background(), c, args...)
+}
+
+// runCMDContext is RunCMD with the command bound to ctx
+func runCMDContext(ctx context.Context, c string, args ...string) ([]byte, error) {
     fullCmd := c
     for i := range args {
         fullCmd += " " + args[i]
     }
 
-    cpout, cperr := exec.Command(c, args...).CombinedOutput()
+    cpout, cperr := execCommandContext(ctx, c, args...).CombinedOutput()
     if cperr != nil {
         return cpout, errors.New("Failed to execute command '" + fullCmd + "': " + cperr.Error())
     }
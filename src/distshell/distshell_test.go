@@ -0,0 +1,904 @@
+package distshell
+
+import (
+    "bytes"
+    "context"
+    "encoding/csv"
+    "errors"
+    "io"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "sync"
+    "syscall"
+    "testing"
+    "time"
+)
+
+// panicTransport panics on every Run
+type panicTransport struct{}
+
+func (panicTransport) Run(ctx context.Context, host string, command []string, stdout io.Writer, stderr io.Writer) error {
+    panic("transport exploded")
+}
+
+func TestExecuteReturnsAfterPanic(t *testing.T) {
+    ds := New([]string{"a", "b", "c"})
+    ds.DisableMonitoring()
+    ds.SetMaxBatch(2)
+    ds.SetTransport(panicTransport{})
+
+    done := make(chan error, 1)
+    go func() { done <- ds.ExecuteAll("true") }()
+    select {
+    case err := <-done:
+        if err == nil {
+            t.Fatal("expected an error from hosts whose transport panicked")
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("Execute did not return after a panic")
+    }
+    for _, h := range ds.HOSTS {
+        if h.CmdError == nil || !strings.Contains(h.CmdError.Error(), "panic") {
+            t.Errorf("host %s: expected a panic error, got %v", h.Name, h.CmdError)
+        }
+        if s := ds.GetHostStatus(h.Name); s != Failed {
+            t.Errorf("host %s: expected status failed, got %s", h.Name, s)
+        }
+    }
+}
+
+func TestEmptyHostNames(t *testing.T) {
+    hosts, errs := buildHost(strings.Split("host1,,host2", ","))
+    if len(hosts) != 2 || len(errs) != 0 || hosts[0].Name != "host1" || hosts[1].Name != "host2" {
+        t.Fatalf("expected host1 and host2, got %+v", hosts)
+    }
+
+    ds := New(strings.Split("host1,,host2", ","))
+    if len(ds.HOSTS) != 2 {
+        t.Fatalf("expected 2 hosts, got %d", len(ds.HOSTS))
+    }
+    for _, name := range []string{"", "  "} {
+        if err := ds.AddHost(name); !errors.Is(err, ErrEmptyHostname) {
+            t.Errorf("AddHost(%q): expected ErrEmptyHostname, got %v", name, err)
+        }
+    }
+    if len(ds.HOSTS) != 2 {
+        t.Errorf("AddHost with an empty name changed the host list to %d hosts", len(ds.HOSTS))
+    }
+}
+
+// fakeExec replaces process creation for the rest of the test, recording each command and running true in its place
+func fakeExec(t *testing.T) func() [][]string {
+    var mu sync.Mutex
+    calls := make([][]string, 0)
+    savedExec, savedLookPath := execCommandContext, lookPath
+    execCommandContext = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+        mu.Lock()
+        calls = append(calls, append([]string{name}, args...))
+        mu.Unlock()
+        return exec.CommandContext(ctx, "true")
+    }
+    lookPath = func(file string) (string, error) { return "/fake/" + file, nil }
+    t.Cleanup(func() { execCommandContext, lookPath = savedExec, savedLookPath })
+    return func() [][]string {
+        mu.Lock()
+        defer mu.Unlock()
+        return calls
+    }
+}
+
+func TestSSHArgs(t *testing.T) {
+    calls := fakeExec(t)
+    ds := New([]string{"web1"})
+    ds.DisableMonitoring()
+    ds.SetUser("bob")
+    ds.SetPort(2222)
+    if err := ds.SetSSHOptions(map[string]string{"batchmode": "no", "ConnectTimeout": "5"}); err != nil {
+        t.Fatal(err)
+    }
+    if err := ds.ExecuteAll("echo", "hi"); err != nil {
+        t.Fatal(err)
+    }
+
+    want := [][]string{{"/fake/ssh", "-o", "StrictHostKeyChecking=no", "-o", "BatchMode=no", "-o", "User=bob",
+        "-o", "Port=2222", "-o", "ConnectTimeout=5", "web1", "echo", "hi", "\nexit", "$?"}}
+    if got := calls(); !reflect.DeepEqual(got, want) {
+        t.Errorf("ssh args\n got %q\nwant %q", got, want)
+    }
+}
+
+func TestSSHOptionsReplaceDefaults(t *testing.T) {
+    ds := New(nil)
+    ds.SetSSHConfigFile("/etc/alt_ssh_config")
+    if err := ds.SetSSHOptions(map[string]string{"stricthostkeychecking": "yes"}); err != nil {
+        t.Fatal(err)
+    }
+    want := []string{"-o", "StrictHostKeyChecking=yes", "-o", "BatchMode=yes", "-F", "/etc/alt_ssh_config"}
+    if got := ds.sshOptions(); !reflect.DeepEqual(got, want) {
+        t.Errorf("ssh options\n got %q\nwant %q", got, want)
+    }
+
+    if err := ds.SetSSHOptions(map[string]string{"Bad Key": "x"}); err == nil {
+        t.Error("expected an error for an option key with a space")
+    }
+    ds.SetSSHOptions(nil)
+    want = []string{"-o", "StrictHostKeyChecking=no", "-o", "BatchMode=yes", "-F", "/etc/alt_ssh_config"}
+    if got := ds.sshOptions(); !reflect.DeepEqual(got, want) {
+        t.Errorf("ssh options after reset\n got %q\nwant %q", got, want)
+    }
+}
+
+func TestSCPArgs(t *testing.T) {
+    calls := fakeExec(t)
+    ds := New([]string{"web1"})
+    ds.DisableMonitoring()
+    ds.SetPort(2222)
+    if err := ds.PutFile("/tmp/local.conf", "/etc/app/"); err != nil {
+        t.Fatal(err)
+    }
+    ds.SetSCPQuiet(false)
+    if err := ds.PutFile("/tmp/local.conf", "/etc/app/"); err != nil {
+        t.Fatal(err)
+    }
+
+    opts := []string{"-o", "StrictHostKeyChecking=no", "-o", "BatchMode=yes", "-o", "Port=2222"}
+    want := [][]string{
+        append(append([]string{"/fake/scp", "-q"}, opts...), "/tmp/local.conf"),
+        append(append([]string{"/fake/scp"}, opts...), "/tmp/local.conf"),
+    }
+    got := make([][]string, 0)
+    for _, call := range calls() {
+        if call[0] != "/fake/scp" {
+            continue
+        }
+        // the upload goes to a temporary file next to the destination
+        if target := call[len(call)-1]; !strings.HasPrefix(target, "web1:/etc/app/.distshell-put-") {
+            t.Errorf("expected a temporary upload target, got %s", target)
+        }
+        got = append(got, call[:len(call)-1])
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("scp args\n got %q\nwant %q", got, want)
+    }
+}
+
+func TestSFTPArgs(t *testing.T) {
+    calls := fakeExec(t)
+    ds := New([]string{"web1"})
+    ds.DisableMonitoring()
+    ds.SetUser("bob")
+    ds.SetUseSFTP(true)
+    if err := ds.PutFile("/tmp/local.conf", "/etc/app/"); err != nil {
+        t.Fatal(err)
+    }
+
+    want := [][]string{{"/fake/sftp", "-b", "-", "-q", "-o", "StrictHostKeyChecking=no", "-o", "BatchMode=yes",
+        "-o", "User=bob", "web1"}}
+    if got := calls(); len(got) == 0 || !reflect.DeepEqual(got[:1], want) {
+        t.Errorf("sftp args\n got %q\nwant %q", got, want)
+    }
+}
+
+func TestRequestTTYOnlyForHostCommands(t *testing.T) {
+    calls := fakeExec(t)
+    ds := New([]string{"web1"})
+    ds.DisableMonitoring()
+    ds.SetRequestTTY(true)
+    if err := ds.ExecuteAll("top", "-b"); err != nil {
+        t.Fatal(err)
+    }
+    want := []string{"/fake/ssh", "-o", "StrictHostKeyChecking=no", "-o", "BatchMode=yes", "-tt", "web1", "top", "-b", "\nexit", "$?"}
+    if got := calls(); len(got) != 1 || !reflect.DeepEqual(got[0], want) {
+        t.Errorf("ssh args\n got %q\nwant %q", got, want)
+    }
+    for _, arg := range ds.sshArgs(&ds.HOSTS[0]) {
+        if arg == "-tt" {
+            t.Error("sshArgs should not request a tty")
+        }
+    }
+}
+
+func TestPlanRoundTripsOptions(t *testing.T) {
+    ds := New([]string{"a", "b"})
+    if err := ds.SetIONice(2, 5); err != nil {
+        t.Fatal(err)
+    }
+    ds.SetWarnOnOverwrite(true)
+    ds.SetOutputFlushInterval(250 * time.Millisecond)
+    ds.SetMaxOutputRate(4096)
+    ds.SetMeasureConnectTime(true)
+    ds.SetParseJSONLines(true)
+    ds.SetChecksumOutput(true)
+    ds.SetSortFailedHosts(true)
+    ds.SetPrefixOutput(true)
+    ds.SetResultBufferSize(4)
+
+    var buf strings.Builder
+    if err := ds.SavePlan(&buf); err != nil {
+        t.Fatal(err)
+    }
+    loaded, err := LoadPlan(strings.NewReader(buf.String()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(loaded.ionice, ds.ionice) {
+        t.Errorf("ionice: got %v, want %v", loaded.ionice, ds.ionice)
+    }
+    if loaded.flushInterval != ds.flushInterval || loaded.maxOutputRate != ds.maxOutputRate || loaded.resultBufferSize != 4 {
+        t.Errorf("flush interval/max output rate/result buffer: got %s/%d/%d", loaded.flushInterval, loaded.maxOutputRate,
+            loaded.resultBufferSize)
+    }
+    if !loaded.warnOnOverwrite || !loaded.measureConnect || !loaded.parseJSONLines || !loaded.checksumOutput ||
+        !loaded.sortFailedHosts || !loaded.prefixOutput {
+        t.Error("boolean options were not restored from the plan")
+    }
+}
+
+func TestLoadPlanValidatesIONice(t *testing.T) {
+    plan := `{"hosts":[{"name":"a"}],"config":{"ionice_class":9}}`
+    if _, err := LoadPlan(strings.NewReader(plan)); err == nil {
+        t.Fatal("expected an invalid ionice class in a plan to be rejected")
+    }
+}
+
+// echoTransport records each remote command and writes it back as the host's output
+type echoTransport struct {
+    mu sync.Mutex
+    commands [][]string
+}
+
+func (e *echoTransport) Run(ctx context.Context, host string, command []string, stdout io.Writer, stderr io.Writer) error {
+    e.mu.Lock()
+    e.commands = append(e.commands, command)
+    e.mu.Unlock()
+    _, err := io.WriteString(stdout, strings.Join(command, " ") + "\n")
+    return err
+}
+
+func TestInteractivePassesLineUnchanged(t *testing.T) {
+    ds := New([]string{"a"})
+    ds.DisableMonitoring()
+    tr := &echoTransport{}
+    ds.SetTransport(tr)
+    var out strings.Builder
+    ds.SetOutput(&out)
+
+    if err := ds.Interactive(strings.NewReader("  grep \"a   b\" /tmp/f  \n")); err != nil {
+        t.Fatal(err)
+    }
+    if len(tr.commands) != 1 || !reflect.DeepEqual(tr.commands[0], []string{`grep "a   b" /tmp/f`}) {
+        t.Errorf("expected the line as typed, got %q", tr.commands)
+    }
+}
+
+func TestInteractiveSkipsOutputWhenRunRefused(t *testing.T) {
+    ds := New([]string{"a"})
+    ds.DisableMonitoring()
+    ds.SetTransport(&echoTransport{})
+    var out strings.Builder
+    ds.SetOutput(&out)
+    ds.HOSTS[0].Stdout = []byte("stale output\n")
+    ds.running.Store(true)
+    defer ds.running.Store(false)
+
+    if err := ds.Interactive(strings.NewReader("uptime\n")); err != nil {
+        t.Fatal(err)
+    }
+    if strings.Contains(out.String(), "stale output") {
+        t.Errorf("results of a previous run were printed for a refused run:\n%s", out.String())
+    }
+    if !strings.Contains(out.String(), ErrAlreadyRunning.Error()) {
+        t.Errorf("expected the refusal to be reported, got:\n%s", out.String())
+    }
+}
+
+func TestSetMaxHistoryClampsToOne(t *testing.T) {
+    ds := New([]string{"a"})
+    ds.DisableMonitoring()
+    ds.SetTransport(&echoTransport{})
+    ds.EnableHistory(true)
+    for _, n := range []int{0, -3} {
+        ds.SetMaxHistory(n)
+        for i := 0; i < 3; i++ {
+            if err := ds.ExecuteAll("true"); err != nil {
+                t.Fatal(err)
+            }
+        }
+        if got := len(ds.History()); got != 1 {
+            t.Errorf("SetMaxHistory(%d): expected 1 run kept, got %d", n, got)
+        }
+    }
+}
+
+func TestPutFileMovesUploadIntoPlace(t *testing.T) {
+    calls := fakeExec(t)
+    ds := New([]string{"web1"})
+    ds.DisableMonitoring()
+    if err := ds.PutFile("/tmp/app.conf", "/etc/app.conf"); err != nil {
+        t.Fatal(err)
+    }
+    got := calls()
+    if len(got) != 2 || got[1][0] != "/fake/ssh" {
+        t.Fatalf("expected an scp upload then an ssh move, got %q", got)
+    }
+    tmp := strings.TrimPrefix(got[0][len(got[0])-1], "web1:")
+    if !strings.HasPrefix(tmp, "/etc/.distshell-put-") {
+        t.Fatalf("expected the upload next to the destination, got %s", tmp)
+    }
+    if script := got[1][len(got[1])-1]; !strings.Contains(script, "mv -f '" + tmp + "' '/etc/app.conf'") {
+        t.Errorf("expected the upload to be moved onto the destination, got %s", script)
+    }
+}
+
+func TestFailedPutFileRemovesOnlyTemporaryFile(t *testing.T) {
+    calls := fakeExec(t)
+    savedExec := execCommandContext
+    execCommandContext = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+        c := savedExec(ctx, name, args...)
+        if name == "/fake/scp" {
+            return exec.CommandContext(ctx, "false")
+        }
+        return c
+    }
+    defer func() { execCommandContext = savedExec }()
+
+    ds := New([]string{"web1"})
+    ds.DisableMonitoring()
+    if err := ds.PutFile("/tmp/app.conf", "/etc/app.conf"); err == nil {
+        t.Fatal("expected the failed upload to be reported")
+    }
+    got := calls()
+    if len(got) != 2 {
+        t.Fatalf("expected an scp upload then an ssh cleanup, got %q", got)
+    }
+    tmp := strings.TrimPrefix(got[0][len(got[0])-1], "web1:")
+    if script := got[1][len(got[1])-1]; script != "rm -f '" + tmp + "'" {
+        t.Errorf("expected only the temporary file to be removed, got %s", script)
+    }
+}
+
+// shellExec makes ssh run the remote command words with a local sh, as sshd would on the remote host
+func shellExec(t *testing.T) {
+    savedExec, savedLookPath := execCommandContext, lookPath
+    execCommandContext = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+        for i := range args {
+            if args[i] == "web1" {
+                return exec.CommandContext(ctx, "sh", "-c", strings.Join(args[i+1:], " "))
+            }
+        }
+        return exec.CommandContext(ctx, "false")
+    }
+    lookPath = func(file string) (string, error) { return "/fake/" + file, nil }
+    t.Cleanup(func() { execCommandContext, lookPath = savedExec, savedLookPath })
+}
+
+func TestRemoteSignal(t *testing.T) {
+    shellExec(t)
+    ds := New([]string{"web1"})
+    ds.DisableMonitoring()
+
+    if err := ds.ExecuteAll("sh", "-c", "'kill -9 $$'"); !errors.Is(ds.HOSTS[0].CmdError, ErrKilledBySignal) {
+        t.Errorf("expected ErrKilledBySignal, got %v (run error %v)", ds.HOSTS[0].CmdError, err)
+    }
+    if sig := ds.GetHostSignal("web1"); sig != syscall.SIGKILL {
+        t.Errorf("expected SIGKILL, got %d", int(sig))
+    }
+    if code := ds.HOSTS[0].ExitCode; code != 137 {
+        t.Errorf("expected the remote shell's exit status 137, got %d", code)
+    }
+
+    ds.ExecuteAll("sh", "-c", "'exit 3'")
+    if sig := ds.GetHostSignal("web1"); sig != 0 || ds.HOSTS[0].ExitCode != 3 {
+        t.Errorf("expected exit status 3 and no signal, got %d and %d", ds.HOSTS[0].ExitCode, int(sig))
+    }
+}
+
+func TestCaptureRemotePIDWithRedirect(t *testing.T) {
+    shellExec(t)
+    redirect := filepath.Join(t.TempDir(), "out")
+    ds := New([]string{"web1"})
+    ds.DisableMonitoring()
+    ds.SetCaptureRemotePID(true)
+    ds.SetHostOutputRedirect("web1", redirect)
+    if err := ds.ExecuteAll("echo", "hi"); err != nil {
+        t.Fatal(err)
+    }
+    if ds.HOSTS[0].RemotePID <= 0 {
+        t.Errorf("expected a remote pid, got %d", ds.HOSTS[0].RemotePID)
+    }
+    if data, err := os.ReadFile(redirect); err != nil || string(data) != "hi\n" {
+        t.Errorf("expected only the command output in the redirect, got %q (%v)", data, err)
+    }
+}
+
+func TestExtractRemotePID(t *testing.T) {
+    tests := []struct {
+        name string
+        out string
+        pid int
+        clean string
+    }{
+        {"no marker", "hello\n", 0, "hello\n"},
+        {"marker first", "__DISTSHELL_PID__1234\nhello\n", 1234, "hello\n"},
+        {"crlf from a pty", "__DISTSHELL_PID__1234\r\nhello\r\n", 1234, "hello\r\n"},
+        {"marker only", "__DISTSHELL_PID__42", 42, ""},
+        {"malformed pid", "__DISTSHELL_PID__abc\nhello\n", 0, "__DISTSHELL_PID__abc\nhello\n"},
+    }
+    for _, tt := range tests {
+        pid, clean := extractRemotePID([]byte(tt.out))
+        if pid != tt.pid || string(clean) != tt.clean {
+            t.Errorf("%s: got %d %q, want %d %q", tt.name, pid, clean, tt.pid, tt.clean)
+        }
+    }
+}
+
+// blockingTransport blocks every command until release is closed
+type blockingTransport struct {
+    started chan string
+    release chan struct{}
+}
+
+func (b *blockingTransport) Run(ctx context.Context, host string, command []string, stdout io.Writer, stderr io.Writer) error {
+    b.started <- host
+    select {
+    case <-b.release:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+func TestDrainedRunReturnsErrDrained(t *testing.T) {
+    tr := &blockingTransport{started: make(chan string, 4), release: make(chan struct{})}
+    ds := New([]string{"a", "b", "c", "d"})
+    ds.DisableMonitoring()
+    ds.SetMaxBatch(1)
+    ds.SetTransport(tr)
+
+    done := make(chan error, 1)
+    go func() { done <- ds.ExecuteAll("sleep") }()
+    <-tr.started
+    drained := make(chan error, 1)
+    go func() { drained <- ds.Drain(context.Background()) }()
+    // wait for Drain to flag the run before letting the first host finish
+    for !ds.draining.Load() {
+        time.Sleep(time.Millisecond)
+    }
+    close(tr.release)
+
+    if err := <-done; !errors.Is(err, ErrDrained) {
+        t.Errorf("expected ErrDrained, got %v", err)
+    }
+    if err := <-drained; err != nil {
+        t.Errorf("Drain: %v", err)
+    }
+    skipped := 0
+    for _, h := range ds.HOSTS {
+        if h.SkipReason == SkipDrained {
+            skipped += 1
+        }
+    }
+    if skipped != 3 {
+        t.Errorf("expected 3 drained hosts, got %d", skipped)
+    }
+}
+
+func TestPidMarkerKeptFromOutputWriters(t *testing.T) {
+    shellExec(t)
+    var out, hostOut strings.Builder
+    ds := New([]string{"web1"})
+    ds.SetOutput(&out)
+    ds.SetPrefixOutput(true)
+    ds.SetCaptureRemotePID(true)
+    ds.SetHostOutputWriter("web1", &hostOut)
+    if err := ds.ExecuteAll("echo", "hi"); err != nil {
+        t.Fatal(err)
+    }
+    if strings.Contains(out.String(), remotePIDMarker) || !strings.Contains(out.String(), "web1: hi\n") {
+        t.Errorf("unexpected prefixed output:\n%s", out.String())
+    }
+    if hostOut.String() != "hi\n" {
+        t.Errorf("expected the host writer to get only the command output, got %q", hostOut.String())
+    }
+    if h := ds.HOSTS[0]; h.OutputBytes != 3 || string(h.Stdout) != "hi\n" || h.RemotePID <= 0 {
+        t.Errorf("got OutputBytes %d, Stdout %q, RemotePID %d", h.OutputBytes, h.Stdout, h.RemotePID)
+    }
+}
+
+func TestMarkerWriter(t *testing.T) {
+    tests := []struct {
+        name string
+        chunks []string
+        pid int
+        out string
+    }{
+        {"whole marker line", []string{"__DISTSHELL_PID__12\nhello\n"}, 12, "hello\n"},
+        {"marker split across writes", []string{"__DISTSH", "ELL_PID__12", "\r\nhel", "lo\n"}, 12, "hello\n"},
+        {"no marker", []string{"hel", "lo\n"}, 0, "hello\n"},
+        {"marker without newline", []string{"__DISTSHELL_PID__7"}, 7, ""},
+        {"short output", []string{"__D"}, 0, "__D"},
+    }
+    for _, tt := range tests {
+        var buf strings.Builder
+        m := &markerWriter{w: &buf}
+        for _, c := range tt.chunks {
+            if n, err := m.Write([]byte(c)); err != nil || n != len(c) {
+                t.Fatalf("%s: Write returned %d, %v", tt.name, n, err)
+            }
+        }
+        m.flush()
+        if m.pid != tt.pid || buf.String() != tt.out {
+            t.Errorf("%s: got %d %q, want %d %q", tt.name, m.pid, buf.String(), tt.pid, tt.out)
+        }
+    }
+}
+
+func TestAllowlistRefusesEmbeddedArgs(t *testing.T) {
+    fakeExec(t)
+    ds := New([]string{"web1"})
+    ds.DisableMonitoring()
+    ds.SetAllowedCommands([]string{"echo"})
+    if ds.AddCommand("web1", "/bin/echo -n ''") {
+        t.Error("expected a command with embedded args to be refused")
+    }
+    if !ds.AddCommand("web1", "/bin/echo", "-n", "") {
+        t.Error("expected the binary with separate args to be accepted")
+    }
+    if err := ds.ExecuteAll("echo hi"); !errors.Is(err, ErrCommandNotAllowed) {
+        t.Errorf("expected ErrCommandNotAllowed, got %v", err)
+    }
+    ds.SetRemoteCommandAsSingleString(true)
+    if !ds.AddCommand("web1", "echo hi") {
+        t.Error("expected a single shell string with args to be accepted")
+    }
+}
+
+func TestConcurrentExecuteAllLeavesRunningCommandsAlone(t *testing.T) {
+    tr := &blockingTransport{started: make(chan string, 2), release: make(chan struct{})}
+    ds := New([]string{"a", "b"})
+    ds.DisableMonitoring()
+    ds.SetTransport(tr)
+
+    done := make(chan error, 1)
+    go func() { done <- ds.ExecuteAll("first") }()
+    <-tr.started
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if err := ds.ExecuteAll("second"); !errors.Is(err, ErrAlreadyRunning) {
+                t.Errorf("expected ErrAlreadyRunning, got %v", err)
+            }
+            if err := ds.Staged().Commit(context.Background()); !errors.Is(err, ErrAlreadyRunning) {
+                t.Errorf("expected ErrAlreadyRunning from Commit, got %v", err)
+            }
+        }()
+    }
+    wg.Wait()
+    close(tr.release)
+    if err := <-done; err != nil {
+        t.Fatal(err)
+    }
+    for _, h := range ds.HOSTS {
+        if h.cmd != "first" {
+            t.Errorf("host %s: command changed to %q during the run", h.Name, h.cmd)
+        }
+    }
+}
+
+func TestResultChannelsReportRunError(t *testing.T) {
+    ds := New([]string{"a", "b"})
+    ds.DisableMonitoring()
+    ds.SetTransport(&echoTransport{})
+    ds.AddCommand("a", "true")
+    ds.AddCommand("b", "true")
+
+    streams := map[string]func() (<-chan HostResult, <-chan error){
+        "ExecuteChan": ds.ExecuteChan,
+        "ExecuteOrderedChan": ds.ExecuteOrderedChan,
+    }
+    for name, stream := range streams {
+        results, errc := stream()
+        n := 0
+        for range results {
+            n += 1
+        }
+        if err := <-errc; err != nil || n != 2 {
+            t.Errorf("%s: got %d results and %v, want 2 and nil", name, n, err)
+        }
+
+        ds.SetApprovalFunc(func(hosts []string, commands string) bool { return false })
+        results, errc = stream()
+        for range results {
+            t.Errorf("%s: a refused run sent a result", name)
+        }
+        if err := <-errc; !errors.Is(err, ErrNotApproved) {
+            t.Errorf("%s: expected ErrNotApproved, got %v", name, err)
+        }
+        ds.SetApprovalFunc(nil)
+    }
+}
+
+func TestExpandHosts(t *testing.T) {
+    tests := []struct {
+        pattern string
+        want []string
+    }{
+        {"web1", []string{"web1"}},
+        {"web[01-03].example.com", []string{"web01.example.com", "web02.example.com", "web03.example.com"}},
+        {"web[8-10]", []string{"web8", "web9", "web10"}},
+        {"web[1-2,5]", []string{"web1", "web2", "web5"}},
+        {"web{a,b,c}", []string{"weba", "webb", "webc"}},
+        {"rack[1-2]-node{a,b}", []string{"rack1-nodea", "rack1-nodeb", "rack2-nodea", "rack2-nodeb"}},
+    }
+    for _, tt := range tests {
+        got, err := ExpandHosts([]string{tt.pattern})
+        if err != nil || !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s: got %q, %v, want %q", tt.pattern, got, err, tt.want)
+        }
+    }
+}
+
+func TestExpandHostsMalformed(t *testing.T) {
+    for _, pattern := range []string{"web[01-", "web]1", "web[]", "web[a-b]", "web[3-1]", "web[1-[2]]", "web{a,b",
+        "web[0-2000000000]", "a[1-1000]b[1-1000]"} {
+        if got, err := ExpandHosts([]string{pattern}); err == nil {
+            t.Errorf("%s: expected an error, got %d hosts", pattern, len(got))
+        }
+    }
+}
+
+func TestMalformedPatternInHostList(t *testing.T) {
+    if _, err := NewFromPatterns([]string{"web1", "web[01-"}); err == nil {
+        t.Error("expected NewFromPatterns to reject a malformed pattern")
+    }
+    ds, err := NewFromPatterns([]string{"web[1-2]"})
+    if err != nil || len(ds.HOSTS) != 2 {
+        t.Fatalf("expected 2 hosts, got %v", err)
+    }
+
+    var out strings.Builder
+    ds = &DistShell{}
+    ds.SetOutput(&out)
+    ds.SetupDistShell([]string{"web[01-"})
+    if len(ds.HOSTS) != 1 || ds.HOSTS[0].Name != "web[01-" || !strings.Contains(out.String(), "WARN") {
+        t.Errorf("expected the pattern kept as a hostname with a warning, got %+v and %q", ds.HOSTS, out.String())
+    }
+}
+
+// planFields lists every DistShell field, true for the options SavePlan and LoadPlan carry and false for run state,
+// functions and values that do not belong in a plan file.  A field missing here fails TestPlanCoversEveryOption
+var planFields = map[string]bool{
+    "HOSTS": true, "defaultCmd": true, "defaultArgs": true,
+    "monitor": true, "maxBatch": true, "adaptiveMin": true, "adaptiveMax": true, "retries": true,
+    "retryableExitCodes": true, "failureThreshold": true, "ignoreConnectErrors": true, "errorOnNoHosts": true,
+    "concurrencyBudget": true, "overallTimeout": true, "cmdTimeout": true, "allowedCommands": true,
+    "user": true, "port": true, "hostKeyPolicy": true, "batchMode": true, "requestTTY": true,
+    "sshExtraOptions": true, "sshConfigFile": true, "bindAddress": true, "compression": true,
+    "captureRemotePID": true, "discardOutput": true, "dedupeLines": true, "normalizeLineEndings": true,
+    "ringSize": true, "stderrTail": true, "nice": true, "ionice": true, "ioniceClass": true, "ioniceLevel": true,
+    "detached": true, "remoteSingleString": true, "useSFTP": true, "scpQuiet": true, "history": true,
+    "maxHistory": true, "templating": true, "warnOnOverwrite": true, "flushInterval": true, "maxOutputRate": true,
+    "measureConnect": true, "parseJSONLines": true, "checksumOutput": true, "sortFailedHosts": true,
+    "prefixOutput": true, "resultBufferSize": true,
+
+    // run state
+    "failedHosts": false, "results": false, "runHistory": false, "inflightMu": false, "outMu": false,
+    "hostsMu": false, "inflight": false, "running": false, "draining": false, "runDone": false, "async": false,
+    "configErr": false, "hostCancels": false, "cancelledHosts": false, "runCancel": false,
+    // functions, writers and shared objects set up by the caller
+    "preHook": false, "postHook": false, "approve": false, "successPredicate": false, "cmdModifier": false,
+    "metrics": false, "transport": false, "transferStderr": false, "out": false, "sharedLimiter": false,
+    "resolver": false, "hostWriters": false, "writerFactory": false, "statusCallback": false,
+    "hostRefresher": false,
+    // masking patterns are often the secrets themselves
+    "secrets": false,
+}
+
+func TestPlanCoversEveryOption(t *testing.T) {
+    typ := reflect.TypeOf((*DistShell)(nil)).Elem()
+    for i := 0; i < typ.NumField(); i++ {
+        if _, ok := planFields[typ.Field(i).Name]; !ok {
+            t.Errorf("DistShell.%s is not in planFields, save it in plans or list it as not planned", typ.Field(i).Name)
+        }
+    }
+}
+
+func TestCaptureRemotePIDRefusesCompoundCommands(t *testing.T) {
+    calls := fakeExec(t)
+    ds := New([]string{"web1"})
+    ds.DisableMonitoring()
+    ds.SetCaptureRemotePID(true)
+    ds.AddCommand("web1", "cd /tmp && ls")
+    if err := ds.Execute(); err == nil || !strings.Contains(ds.HOSTS[0].CmdError.Error(), "shell operators") {
+        t.Errorf("expected the compound command to be refused, got %v", ds.HOSTS[0].CmdError)
+    }
+    if got := calls(); len(got) != 0 {
+        t.Errorf("expected nothing to run, got %q", got)
+    }
+    ds.AddCommand("web1", "ls", "-l", "/tmp")
+    if err := ds.Execute(); err != nil {
+        t.Errorf("expected a single command to run, got %v", err)
+    }
+}
+
+func TestDiffRuns(t *testing.T) {
+    r := func(name, out string) HostResult { return HostResult{Name: name, Stdout: []byte(out)} }
+    tests := []struct {
+        name string
+        before []HostResult
+        after []HostResult
+        want map[string][2]string
+    }{
+        {"no change", []HostResult{r("a", "x")}, []HostResult{r("a", "x")}, map[string][2]string{}},
+        {"changed", []HostResult{r("a", "x"), r("b", "y")}, []HostResult{r("a", "x"), r("b", "z")},
+            map[string][2]string{"b": {"y", "z"}}},
+        {"added host", []HostResult{r("a", "x")}, []HostResult{r("a", "x"), r("b", "y")},
+            map[string][2]string{"b": {"", "y"}}},
+        {"removed host", []HostResult{r("a", "x"), r("b", "y")}, []HostResult{r("a", "x")},
+            map[string][2]string{"b": {"y", ""}}},
+        {"empty runs", nil, nil, map[string][2]string{}},
+    }
+    for _, tt := range tests {
+        diff := DiffRuns(tt.before, tt.after)
+        got := make(map[string][2]string, len(diff))
+        for name, d := range diff {
+            got[name] = [2]string{string(d[0]), string(d[1])}
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestTimingStats(t *testing.T) {
+    ran := func(d time.Duration) HostResult {
+        start := time.Now()
+        return HostResult{StartedAt: start, FinishedAt: start.Add(d), Duration: d}
+    }
+    ms := time.Millisecond
+    tests := []struct {
+        name string
+        results []HostResult
+        want Stats
+    }{
+        {"no results", nil, Stats{}},
+        {"only skipped", []HostResult{{SkipReason: SkipDrained}}, Stats{}},
+        {"one host", []HostResult{ran(5 * ms)}, Stats{Count: 1, Min: 5 * ms, Max: 5 * ms, Median: 5 * ms, P95: 5 * ms}},
+        {"odd count", []HostResult{ran(30 * ms), ran(10 * ms), ran(20 * ms), {SkipReason: SkipCancelled}},
+            Stats{Count: 3, Min: 10 * ms, Max: 30 * ms, Median: 20 * ms, P95: 30 * ms}},
+        {"even count", []HostResult{ran(10 * ms), ran(40 * ms), ran(20 * ms), ran(30 * ms)},
+            Stats{Count: 4, Min: 10 * ms, Max: 40 * ms, Median: 25 * ms, P95: 40 * ms}},
+    }
+    for _, tt := range tests {
+        ds := New(nil)
+        ds.results = tt.results
+        if got := ds.TimingStats(); got != tt.want {
+            t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+        }
+    }
+
+    // nearest rank over 20 hosts is the 19th fastest
+    results := make([]HostResult, 20)
+    for i := range results {
+        results[i] = ran(time.Duration(i + 1) * ms)
+    }
+    ds := New(nil)
+    ds.results = results
+    if p95 := ds.TimingStats().P95; p95 != 19 * ms {
+        t.Errorf("p95 of 1..20ms: got %s, want 19ms", p95)
+    }
+}
+
+func TestWriteResultsCSV(t *testing.T) {
+    ds := New(nil)
+    ds.results = []HostResult{
+        {Name: "a", Stdout: []byte("one,two\n\"quoted\"\n"), Duration: 1500 * time.Millisecond},
+        {Name: "b", ExitCode: 2, Error: errors.New("exit status 2")},
+        {Name: "c", ExitCode: -1, SkipReason: SkipDrained},
+        {Name: "d", Stdout: []byte(strings.Repeat("é", csvPreviewBytes))},
+    }
+    var buf strings.Builder
+    if err := ds.WriteResultsCSV(&buf); err != nil {
+        t.Fatal(err)
+    }
+    rows, err := csv.NewReader(strings.NewReader(buf.String())).ReadAll()
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := [][]string{
+        {"host", "exit_code", "duration_ms", "error", "stdout"},
+        {"a", "0", "1500", "", "one,two\n\"quoted\"\n"},
+        {"b", "2", "0", "exit status 2", ""},
+        {"c", "-1", "0", "skipped: drained", ""},
+        {"d", "0", "0", "", strings.Repeat("é", csvPreviewBytes / 2)},
+    }
+    if !reflect.DeepEqual(rows, want) {
+        t.Errorf("got %q\nwant %q", rows, want)
+    }
+}
+
+func TestDedupeLines(t *testing.T) {
+    tests := []struct {
+        in string
+        want string
+    }{
+        {"", ""},
+        {"a\nb\n", "a\nb\n"},
+        {"a\na\na\nb\n", "a (repeated 3 times)\nb\n"},
+        {"a\nb\nb\na\n", "a\nb (repeated 2 times)\na\n"},
+        {"a\na", "a\na"},
+        {"x\nx\n", "x (repeated 2 times)\n"},
+    }
+    for _, tt := range tests {
+        if got := string(dedupeLines([]byte(tt.in))); got != tt.want {
+            t.Errorf("dedupeLines(%q) = %q, want %q", tt.in, got, tt.want)
+        }
+    }
+}
+
+func TestOutputCapture(t *testing.T) {
+    tests := []struct {
+        name string
+        capture *outputCapture
+        writes []string
+        want string
+    }{
+        {"unbounded", &outputCapture{}, []string{"abc", "def"}, "abcdef"},
+        {"discard", &outputCapture{discard: true}, []string{"abc", "def"}, ""},
+        {"ring keeps the tail", &outputCapture{ring: 4}, []string{"abc", "def"}, "cdef"},
+        {"ring write larger than the ring", &outputCapture{ring: 4}, []string{"ab", "cdefgh"}, "efgh"},
+        {"ring not yet full", &outputCapture{ring: 10}, []string{"abc"}, "abc"},
+    }
+    for _, tt := range tests {
+        total := 0
+        for _, w := range tt.writes {
+            if n, err := tt.capture.Write([]byte(w)); err != nil || n != len(w) {
+                t.Fatalf("%s: Write returned %d, %v", tt.name, n, err)
+            }
+            total += len(w)
+        }
+        if got := string(tt.capture.Bytes()); got != tt.want || tt.capture.n != int64(total) {
+            t.Errorf("%s: got %q counting %d, want %q counting %d", tt.name, got, tt.capture.n, tt.want, total)
+        }
+    }
+}
+
+func TestOffsetWriter(t *testing.T) {
+    tests := []struct {
+        name string
+        chunks []string
+        start, size int64
+        out string
+        wantErr bool
+    }{
+        {"header and data", []string{"0 5\nhello"}, 0, 5, "hello", false},
+        {"split header", []string{"12 1", "7\nabc", "de"}, 12, 17, "abcde", false},
+        {"header only", []string{"3 3\n"}, 3, 3, "", false},
+        {"malformed header", []string{"oops\nhello"}, 0, 0, "", true},
+    }
+    for _, tt := range tests {
+        var buf bytes.Buffer
+        o := &offsetWriter{w: &buf}
+        var err error
+        for _, c := range tt.chunks {
+            if _, err = o.Write([]byte(c)); err != nil {
+                break
+            }
+        }
+        if (err != nil) != tt.wantErr {
+            t.Errorf("%s: unexpected error %v", tt.name, err)
+            continue
+        }
+        if tt.wantErr {
+            continue
+        }
+        if !o.done || o.start != tt.start || o.size != tt.size || buf.String() != tt.out || o.written != int64(len(tt.out)) {
+            t.Errorf("%s: got start %d size %d written %d %q", tt.name, o.start, o.size, o.written, buf.String())
+        }
+    }
+}
@@ -0,0 +1,129 @@
+package distshell
+
+import (
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+/*
+ *   Host list expansion in the spirit of pdsh's hostlist syntax
+ *   web[01-03].example.com  = web01.example.com, web02.example.com, web03.example.com
+ *   web[1-2,5]              = web1, web2, web5
+ *   web{a,b,c}              = weba, webb, webc
+ *   Several groups in one name expand left to right, so rack[1-2]-node[1-2] yields four hosts
+ *   A pattern may expand to at most maxExpandedHosts hosts
+ */
+
+// maxExpandedHosts caps the hosts a single pattern expands to so a typo such as web[0-2000000000] fails fast
+const maxExpandedHosts = 100000
+
+// ExpandHosts expands range and brace patterns in the given host names and returns the flattened list
+func ExpandHosts(hList []string) ([]string, error) {
+    names := make([]string, 0, len(hList))
+    for i := range hList {
+        expanded, err := expandHost(hList[i])
+        if err != nil {
+            return nil, err
+        }
+        names = append(names, expanded...)
+    }
+    return names, nil
+}
+
+// expandHost expands a single host pattern
+func expandHost(pattern string) ([]string, error) {
+    open := strings.IndexAny(pattern, "[{")
+    if open < 0 {
+        if strings.ContainsAny(pattern, "]}") {
+            return nil, fmt.Errorf("malformed host pattern %q: unexpected closing bracket", pattern)
+        }
+        return []string{pattern}, nil
+    }
+
+    closer := "]"
+    if pattern[open] == '{' {
+        closer = "}"
+    }
+    end := strings.Index(pattern[open+1:], closer)
+    if end < 0 {
+        return nil, fmt.Errorf("malformed host pattern %q: missing %s", pattern, closer)
+    }
+    end += open + 1
+    body := pattern[open+1 : end]
+    if strings.ContainsAny(body, "[]{}") {
+        return nil, fmt.Errorf("malformed host pattern %q: nested groups are not supported", pattern)
+    }
+
+    prefix := pattern[:open]
+    if strings.ContainsAny(prefix, "]}") {
+        return nil, fmt.Errorf("malformed host pattern %q: unexpected closing bracket", pattern)
+    }
+
+    var items []string
+    var err error
+    if closer == "]" {
+        items, err = expandRange(body)
+        if err != nil {
+            return nil, fmt.Errorf("malformed host pattern %q: %s", pattern, err)
+        }
+    } else {
+        items = strings.Split(body, ",")
+    }
+
+    // expand whatever follows this group and combine
+    suffixes, err := expandHost(pattern[end+1:])
+    if err != nil {
+        return nil, err
+    }
+    if len(items) * len(suffixes) > maxExpandedHosts {
+        return nil, fmt.Errorf("malformed host pattern %q: expands to more than %d hosts", pattern, maxExpandedHosts)
+    }
+    names := make([]string, 0, len(items)*len(suffixes))
+    for i := range items {
+        for s := range suffixes {
+            names = append(names, prefix+items[i]+suffixes[s])
+        }
+    }
+    return names, nil
+}
+
+// expandRange expands the body of a bracket group such as "01-10,15"
+func expandRange(body string) ([]string, error) {
+    if body == "" {
+        return nil, errors.New("empty range")
+    }
+    items := make([]string, 0)
+    for _, part := range strings.Split(body, ",") {
+        bounds := strings.SplitN(part, "-", 2)
+        lo, err := strconv.Atoi(bounds[0])
+        if err != nil || lo < 0 {
+            return nil, fmt.Errorf("invalid range value %q", bounds[0])
+        }
+        if len(bounds) == 1 {
+            items = append(items, part)
+            continue
+        }
+        hi, err := strconv.Atoi(bounds[1])
+        if err != nil || hi < 0 {
+            return nil, fmt.Errorf("invalid range value %q", bounds[1])
+        }
+        if lo > hi {
+            return nil, fmt.Errorf("invalid range %q: start is greater than end", part)
+        }
+        if hi - lo >= maxExpandedHosts - len(items) {
+            return nil, fmt.Errorf("range %q expands to more than %d hosts", body, maxExpandedHosts)
+        }
+
+        // a leading zero on the start value means the whole range is zero padded
+        width := 0
+        if len(bounds[0]) > 1 && bounds[0][0] == '0' {
+            width = len(bounds[0])
+        }
+        for n := lo; n <= hi; n++ {
+            items = append(items, fmt.Sprintf("%0*d", width, n))
+        }
+    }
+    return items, nil
+}
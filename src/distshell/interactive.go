@@ -0,0 +1,95 @@
+package distshell
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "io"
+    "sort"
+    "strings"
+)
+
+// interactivePrompt is written before each command line is read
+const interactivePrompt = "distshell> "
+
+// Interactive reads command lines from r and runs each one on every host with ExecuteAll, writing the output
+// grouped by identical result to the output before prompting for the next line.  It returns nil at EOF or on
+// a line of exit or quit, and the reader's error otherwise.  The line reaches the remote shell as typed, and only the
+// error is written when the run is refused, for example while another run is in progress
+func (ds *DistShell) Interactive(r io.Reader) error {
+    scanner := bufio.NewScanner(r)
+    out := ds.output()
+    for {
+        fmt.Fprint(out, interactivePrompt)
+        if !scanner.Scan() {
+            fmt.Fprintln(out)
+            return scanner.Err()
+        }
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" {
+            continue
+        }
+        if line == "exit" || line == "quit" {
+            return nil
+        }
+
+        if ds.allowedCommands != nil && strings.ContainsAny(line, shellMetaChars) {
+            fmt.Fprintf(out, "ERROR: %s: shell metacharacters in %s\n", ErrCommandNotAllowed, ds.mask(line))
+            continue
+        }
+        var err error
+        if ds.allowedCommands != nil && !ds.remoteSingleString {
+            // the allowlist quotes every word, so the line has to be split back into the command and its args
+            fields := strings.Fields(line)
+            err = ds.ExecuteAll(fields[0], fields[1:]...)
+        } else {
+            // the remote shell parses the line as typed, quotes and all
+            err = ds.ExecuteAll(line)
+        }
+        if ds.runStarted(err) {
+            ds.writeGroupedOutput(out)
+        }
+        if err != nil {
+            fmt.Fprintf(out, "ERROR: %s\n", err)
+        }
+    }
+}
+
+// runStarted reports whether a run that returned err got as far as running the hosts, so their results are its own
+func (ds *DistShell) runStarted(err error) bool {
+    switch {
+    case err == nil:
+        return true
+    case ds.configErr != nil && err == ds.configErr:
+        return false
+    }
+    return !errors.Is(err, ErrAlreadyRunning) && !errors.Is(err, ErrCommandNotAllowed) &&
+        !errors.Is(err, ErrNotApproved) && !errors.Is(err, ErrNoHosts)
+}
+
+// writeGroupedOutput writes each group of hosts with identical output under a header listing the hosts,
+// groups are ordered by their first host
+func (ds *DistShell) writeGroupedOutput(out io.Writer) {
+    order := make(map[string]int)
+    for i := range ds.HOSTS {
+        order[ds.HOSTS[i].Name] = i
+    }
+    groups := ds.GroupByOutput()
+    outputs := make([]string, 0, len(groups))
+    for output := range groups {
+        outputs = append(outputs, output)
+    }
+    sort.Slice(outputs, func(i, j int) bool {
+        return order[groups[outputs[i]][0]] < order[groups[outputs[j]][0]]
+    })
+
+    for _, output := range outputs {
+        fmt.Fprintln(out, "----------------")
+        fmt.Fprintln(out, strings.Join(groups[output], ","))
+        fmt.Fprintln(out, "----------------")
+        fmt.Fprint(out, output)
+        if output != "" && !strings.HasSuffix(output, "\n") {
+            fmt.Fprintln(out)
+        }
+    }
+}
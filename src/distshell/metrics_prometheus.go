@@ -0,0 +1,80 @@
+//go:build prometheus
+
+package distshell
+
+import (
+    "errors"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// promMetrics exports run statistics to prometheus, it is only built with the prometheus build tag
+type promMetrics struct {
+    commands prometheus.Counter
+    failures prometheus.Counter
+    duration prometheus.Histogram
+}
+
+// RegisterMetrics registers counters for hosts run and failed and a histogram of command durations
+// and updates them as hosts complete.  Build with -tags prometheus to include it
+// Collectors already registered by another DistShell are shared so several instances can report together
+func (ds *DistShell) RegisterMetrics(registerer prometheus.Registerer) error {
+    m := &promMetrics{
+        commands: prometheus.NewCounter(prometheus.CounterOpts{
+            Namespace: "distshell",
+            Name: "commands_total",
+            Help: "Number of host commands and transfers run.",
+        }),
+        failures: prometheus.NewCounter(prometheus.CounterOpts{
+            Namespace: "distshell",
+            Name: "failures_total",
+            Help: "Number of host commands and transfers that failed.",
+        }),
+        duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+            Namespace: "distshell",
+            Name: "command_duration_seconds",
+            Help: "Duration of host commands in seconds.",
+            Buckets: prometheus.DefBuckets,
+        }),
+    }
+
+    var err error
+    if m.commands, err = registerCounter(registerer, m.commands); err != nil {
+        return err
+    }
+    if m.failures, err = registerCounter(registerer, m.failures); err != nil {
+        return err
+    }
+    if err := registerer.Register(m.duration); err != nil {
+        var are prometheus.AlreadyRegisteredError
+        if !errors.As(err, &are) {
+            return err
+        }
+        m.duration = are.ExistingCollector.(prometheus.Histogram)
+    }
+    ds.metrics = m
+    return nil
+}
+
+// registerCounter registers c, returning the existing counter if one with the same name is already registered
+func registerCounter(registerer prometheus.Registerer, c prometheus.Counter) (prometheus.Counter, error) {
+    if err := registerer.Register(c); err != nil {
+        var are prometheus.AlreadyRegisteredError
+        if !errors.As(err, &are) {
+            return nil, err
+        }
+        return are.ExistingCollector.(prometheus.Counter), nil
+    }
+    return c, nil
+}
+
+// observe implements hostObserver
+func (m *promMetrics) observe(h *Host, failed bool) {
+    m.commands.Inc()
+    if failed {
+        m.failures.Inc()
+    }
+    if !h.StartedAt.IsZero() && !h.FinishedAt.IsZero() {
+        m.duration.Observe(h.FinishedAt.Sub(h.StartedAt).Seconds())
+    }
+}
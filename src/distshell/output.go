@@ -0,0 +1,373 @@
+package distshell
+
+import (
+    "encoding/json"
+    "crypto/sha256"
+    "encoding/hex"
+    "context"
+    "time"
+    "fmt"
+    "io"
+    "bytes"
+    "strings"
+    "sync"
+)
+
+// defaultStderrTail is the number of stderr lines FailureSummaries returns per host
+const defaultStderrTail = 5
+
+// outputCapture collects the combined output of a command
+// In discard mode the bytes are only counted, which keeps memory flat for commands with huge output
+// stdout and stderr are copied by separate go routines so writes are serialized
+type outputCapture struct {
+    mu sync.Mutex
+    buf bytes.Buffer
+    n int64
+    discard bool
+    ring int // when positive only the last ring bytes are kept
+}
+
+// Write implements io.Writer
+func (c *outputCapture) Write(p []byte) (int, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.n += int64(len(p))
+    if c.discard {
+        return len(p), nil
+    }
+    if c.ring <= 0 {
+        return c.buf.Write(p)
+    }
+    if len(p) >= c.ring {
+        c.buf.Reset()
+        c.buf.Write(p[len(p)-c.ring:])
+        return len(p), nil
+    }
+    c.buf.Write(p)
+    if over := c.buf.Len() - c.ring; over > 0 {
+        c.buf.Next(over)
+    }
+    return len(p), nil
+}
+
+// Bytes returns the captured output, which is empty in discard mode
+func (c *outputCapture) Bytes() []byte {
+    return c.buf.Bytes()
+}
+
+// SetRingBufferSize keeps only the most recent n bytes of each host's stdout and stderr, bounding memory for
+// long or streaming commands.  Host.OutputBytes still counts everything.  The remote pid marker is written
+// first so it is lost once output passes n bytes.  0 keeps all output and is the default
+func (ds *DistShell) SetRingBufferSize(n int) {
+    ds.ringSize = n
+}
+
+// SetNormalizeLineEndings converts CRLF line endings to LF in each host's stdout and stderr before they are stored
+// Default is false so output is kept exactly as it was written
+func (ds *DistShell) SetNormalizeLineEndings(normalize bool) {
+    ds.normalizeLineEndings = normalize
+}
+
+// SetHostOutputWriter copies the host's stdout and stderr to w as the command produces them, in addition to
+// Host.Stdout.  Combine with SetDiscardOutput to stream without buffering.  A nil w removes the writer
+func (ds *DistShell) SetHostOutputWriter(h string, w io.Writer) {
+    if ds.hostWriters == nil {
+        ds.hostWriters = make(map[string]io.Writer)
+    }
+    if w == nil {
+        delete(ds.hostWriters, h)
+        return
+    }
+    ds.hostWriters[h] = w
+}
+
+// SetOutputWriterFactory sets a function asked for a writer each time a command starts on a host, for hosts
+// without a writer from SetHostOutputWriter.  fn may return nil to skip a host and is called from several go routines
+func (ds *DistShell) SetOutputWriterFactory(fn func(host string) io.Writer) {
+    ds.writerFactory = fn
+}
+
+// hostOutputWriter returns the writer the host's output is copied to, or nil
+// stdout and stderr are written from separate go routines so the writer is serialized
+func (ds *DistShell) hostOutputWriter(h string) io.Writer {
+    w := ds.hostWriters[h]
+    if w == nil && ds.writerFactory != nil {
+        w = ds.writerFactory(h)
+    }
+    if w == nil {
+        return nil
+    }
+    return &syncWriter{w: w}
+}
+
+// syncWriter serializes writes to w
+type syncWriter struct {
+    mu sync.Mutex
+    w io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.w.Write(p)
+}
+
+// lockedWriter serializes writes to w with a mutex shared by several writers
+type lockedWriter struct {
+    mu *sync.Mutex
+    w io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return l.w.Write(p)
+}
+
+// SetPrefixOutput prints every line of command output to the output as "host: line" while commands run, in the style
+// of pdsh, when monitoring is enabled.  Lines from different hosts interleave but a line is never split.  Host.Stdout
+// is captured without the prefix.  Default is false
+func (ds *DistShell) SetPrefixOutput(enable bool) {
+    ds.prefixOutput = enable
+}
+
+// prefixWriter writes each complete line written to it to w as prefix + line
+type prefixWriter struct {
+    mu sync.Mutex
+    prefix string
+    w io.Writer
+    buf []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.buf = append(p.buf, b...)
+    for {
+        i := bytes.IndexByte(p.buf, '\n')
+        if i < 0 {
+            break
+        }
+        p.writeLine(p.buf[:i])
+        p.buf = p.buf[i+1:]
+    }
+    return len(b), nil
+}
+
+// flush writes a trailing line that did not end in a newline
+func (p *prefixWriter) flush() {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if len(p.buf) > 0 {
+        p.writeLine(p.buf)
+        p.buf = nil
+    }
+}
+
+func (p *prefixWriter) writeLine(line []byte) {
+    // one write per line keeps it whole on the shared output
+    fmt.Fprintf(p.w, "%s%s\n", p.prefix, bytes.TrimRight(line, "\r"))
+}
+
+// SetMeasureConnectTime records in Host.ConnectDuration how long each command took to send its first byte back.
+// A marker is echoed before the command starts, as with remote pid capture, so this approximates ssh connection
+// setup apart from the command itself.  It is not measured with SetRemoteCommandAsSingleString or SetDetached
+func (ds *DistShell) SetMeasureConnectTime(measure bool) {
+    ds.measureConnect = measure
+}
+
+// firstByteWriter records when the first byte is written to it
+type firstByteWriter struct {
+    mu sync.Mutex
+    at time.Time
+}
+
+func (f *firstByteWriter) Write(p []byte) (int, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    if f.at.IsZero() && len(p) > 0 {
+        f.at = time.Now()
+    }
+    return len(p), nil
+}
+
+// since returns the time from start to the first byte, or to now if nothing was written
+func (f *firstByteWriter) since(start time.Time) time.Duration {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    if f.at.IsZero() {
+        return time.Since(start)
+    }
+    return f.at.Sub(start)
+}
+
+// SetFailureStderrTail sets how many trailing stderr lines FailureSummaries returns per failed host.  Default is 5
+func (ds *DistShell) SetFailureStderrTail(n int) {
+    ds.stderrTail = n
+}
+
+// FailureSummaries returns the last lines of stderr for every host that failed in the most recent run
+func (ds *DistShell) FailureSummaries() map[string]string {
+    summaries := make(map[string]string)
+    for i := range ds.results {
+        if ds.results[i].Error != nil {
+            summaries[ds.results[i].Name] = tailLines(string(ds.results[i].Stderr), ds.stderrTail)
+        }
+    }
+    return summaries
+}
+
+// tailLines returns the last n lines of s
+func tailLines(s string, n int) string {
+    lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+    if n >= 0 && len(lines) > n {
+        lines = lines[len(lines)-n:]
+    }
+    return strings.Join(lines, "\n")
+}
+
+// SetDedupeOutputLines collapses consecutive identical lines of each host's output into one line
+// annotated with "(repeated N times)".  Default is false so output is kept exactly as it was written
+func (ds *DistShell) SetDedupeOutputLines(dedupe bool) {
+    ds.dedupeLines = dedupe
+}
+
+// dedupeLines collapses runs of identical lines in out
+func dedupeLines(out []byte) []byte {
+    if len(out) == 0 {
+        return out
+    }
+    var deduped bytes.Buffer
+    lines := bytes.SplitAfter(out, []byte("\n"))
+    for i := 0; i < len(lines); {
+        n := 1
+        for i+n < len(lines) && bytes.Equal(lines[i+n], lines[i]) {
+            n += 1
+        }
+        if n == 1 {
+            deduped.Write(lines[i])
+        } else {
+            // the annotation goes before the newline so the line count stays meaningful
+            deduped.Write(bytes.TrimSuffix(lines[i], []byte("\n")))
+            fmt.Fprintf(&deduped, " (repeated %d times)\n", n)
+        }
+        i += n
+    }
+    return deduped.Bytes()
+}
+
+// SetMaxOutputRate limits how fast each host's output is read to bytesPerSec, stdout and stderr combined
+// A host writing faster is slowed down by back pressure on its ssh connection.  0 means unlimited and is the default
+func (ds *DistShell) SetMaxOutputRate(bytesPerSec int) {
+    ds.maxOutputRate = bytesPerSec
+}
+
+// tokenBucket allows rate bytes per second with a burst of one second's worth
+type tokenBucket struct {
+    mu sync.Mutex
+    rate float64
+    tokens float64
+    last time.Time
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+    return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// take removes n tokens and returns how long the caller must wait before using them
+func (b *tokenBucket) take(n int) time.Duration {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    now := time.Now()
+    b.tokens += now.Sub(b.last).Seconds() * b.rate
+    if b.tokens > b.rate {
+        b.tokens = b.rate
+    }
+    b.last = now
+    b.tokens -= float64(n)
+    if b.tokens >= 0 {
+        return 0
+    }
+    return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimitedWriter holds up writes to w so they stay within the bucket's rate
+type rateLimitedWriter struct {
+    ctx context.Context
+    w io.Writer
+    bucket *tokenBucket
+}
+
+func (r *rateLimitedWriter) Write(p []byte) (int, error) {
+    written := 0
+    for written < len(p) {
+        // never ask for more than the burst in one go
+        chunk := len(p) - written
+        if chunk > int(r.bucket.rate) {
+            chunk = int(r.bucket.rate)
+        }
+        if wait := r.bucket.take(chunk); wait > 0 {
+            timer := time.NewTimer(wait)
+            select {
+            case <-timer.C:
+            case <-r.ctx.Done():
+                timer.Stop()
+                return written, r.ctx.Err()
+            }
+        }
+        n, err := r.w.Write(p[written:written+chunk])
+        written += n
+        if err != nil {
+            return written, err
+        }
+    }
+    return written, nil
+}
+
+// SetParseJSONLines parses each line of a host's stdout as a JSON object into Host.JSON after its command runs
+// Blank lines are ignored and lines that do not parse are kept in Host.JSONErrors.  Default is false
+func (ds *DistShell) SetParseJSONLines(parse bool) {
+    ds.parseJSONLines = parse
+}
+
+// GetHostJSON returns the JSON objects parsed from the host's stdout, nil if the host is unknown
+func (ds *DistShell) GetHostJSON(h string) []map[string]any {
+    for i := range ds.HOSTS {
+        if ds.HOSTS[i].Name == h {
+            return ds.HOSTS[i].JSON
+        }
+    }
+    return nil
+}
+
+// SetChecksumOutput stores the hex SHA-256 of each host's stdout in Host.OutputChecksum so outputs can be compared
+// with ChecksumGroups without holding on to them.  The checksum covers the stdout as captured, after line ending
+// normalization and deduplication, so with SetRingBufferSize or SetDiscardOutput it only covers what was kept.  Default is false
+func (ds *DistShell) SetChecksumOutput(enable bool) {
+    ds.checksumOutput = enable
+}
+
+// checksum returns the hex SHA-256 of b
+func checksum(b []byte) string {
+    sum := sha256.Sum256(b)
+    return hex.EncodeToString(sum[:])
+}
+
+// parseJSONLines parses every non blank line of out as a JSON object
+func parseJSONLines(out []byte) ([]map[string]any, []string) {
+    objects := make([]map[string]any, 0)
+    var errs []string
+    for _, line := range strings.Split(string(out), "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" {
+            continue
+        }
+        var obj map[string]any
+        if err := json.Unmarshal([]byte(line), &obj); err != nil {
+            errs = append(errs, line)
+            continue
+        }
+        objects = append(objects, obj)
+    }
+    return objects, errs
+}
@@ -0,0 +1,125 @@
+package distshell
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "os"
+    "strings"
+    "time"
+)
+
+// brokenPipeExitCode is the status a shell reports for a command killed by SIGPIPE
+const brokenPipeExitCode = 141
+
+/*
+ *   PipeToLocal runs remoteCmd on every host and streams its stdout into a new local process per host
+ *   remoteCmd = cat /var/log/messages
+ *   localCmd  = grep, localArgs = -c, ERROR
+ *   The local command's stdout becomes Host.Stdout and its exit code Host.ExitCode.  Host.Stderr holds the remote
+ *   stderr followed by the local stderr.  An ssh connection error is always reported, any other remote failure only
+ *   when the local command succeeded.  A remote command killed by a broken pipe because the local command stopped
+ *   reading early, like head, is not a failure
+ */
+func (ds *DistShell) PipeToLocal(remoteCmd string, localCmd string, localArgs ...string) error {
+    return ds.PipeToLocalContext(context.Background(), remoteCmd, localCmd, localArgs...)
+}
+
+// PipeToLocalContext is PipeToLocal bound to ctx
+func (ds *DistShell) PipeToLocalContext(ctx context.Context, remoteCmd string, localCmd string, localArgs ...string) error {
+    if !ds.binaryAllowed(remoteCmd) {
+        return fmt.Errorf("%w: %s", ErrCommandNotAllowed, ds.mask(remoteCmd))
+    }
+    if ds.allowedCommands != nil && strings.ContainsAny(remoteCmd, shellMetaChars) {
+        return fmt.Errorf("%w: shell metacharacters in %s", ErrCommandNotAllowed, ds.mask(remoteCmd))
+    }
+    LOCAL, lookupErr := lookPath(localCmd)
+    if lookupErr != nil {
+        return fmt.Errorf("unable to find %s in $PATH: %s", localCmd, lookupErr)
+    }
+    SSH := ""
+    if ds.transport == nil {
+        SSH, lookupErr = lookPath("ssh")
+        if lookupErr != nil {
+            return fmt.Errorf("unable to find ssh in $PATH: %s", lookupErr)
+        }
+    }
+    hosts := ds.allHosts()
+    if !ds.approved(hosts, ds.mask(remoteCmd + " | " + joinCommand(localCmd, localArgs))) {
+        return ErrNotApproved
+    }
+
+    return ds.runBatch(ctx, hosts, func(ctx context.Context, h *Host) string {
+        if timeout := ds.commandTimeout(h); timeout > 0 {
+            var cancel context.CancelFunc
+            ctx, cancel = context.WithTimeout(ctx, timeout)
+            defer cancel()
+        }
+        h.StartedAt = time.Now()
+        defer func() { h.FinishedAt = time.Now() }()
+        h.Stdout = nil
+        h.Stderr = nil
+
+        r, w, err := os.Pipe()
+        if err != nil {
+            h.CmdError = err
+            h.ExitCode = -1
+            return fmt.Sprintf("ERROR: Failed to pipe output of host %s: %s", h.Name, err)
+        }
+        var localOut, localErr, remoteErr bytes.Buffer
+        local := execCommandContext(ctx, LOCAL, localArgs...)
+        local.Stdin = r
+        local.Stdout = &localOut
+        local.Stderr = &localErr
+        if err := local.Start(); err != nil {
+            r.Close()
+            w.Close()
+            h.CmdError = err
+            h.ExitCode = -1
+            return fmt.Sprintf("ERROR: Failed to start %s for host %s: %s", localCmd, h.Name, err)
+        }
+        // the local process holds its own copy of the read end
+        r.Close()
+
+        var remoteRunErr error
+        if ds.transport != nil {
+            remoteRunErr = ds.transport.Run(ctx, ds.target(h.Name), []string{remoteCmd}, w, &remoteErr)
+        } else {
+            c := execCommandContext(ctx, SSH, append(ds.sshArgs(h), remoteCmd)...)
+            if ds.cmdModifier != nil {
+                ds.cmdModifier(c)
+            }
+            c.Stdout = w
+            c.Stderr = &remoteErr
+            remoteRunErr = c.Run()
+        }
+        w.Close()
+        localRunErr := local.Wait()
+
+        h.Stdout = localOut.Bytes()
+        h.Stderr = append(remoteErr.Bytes(), localErr.Bytes()...)
+        h.OutputBytes = int64(len(h.Stdout))
+        switch {
+        case remoteRunErr != nil && exitCode(remoteRunErr) == connectErrorExitCode:
+            // the local command saw no output, its result means nothing
+            h.CmdError = fmt.Errorf("remote command failed: %w", remoteRunErr)
+            h.ExitCode = connectErrorExitCode
+        case localRunErr != nil:
+            h.CmdError = localRunErr
+            h.ExitCode = exitCode(localRunErr)
+        case remoteRunErr != nil && exitCode(remoteRunErr) != brokenPipeExitCode:
+            h.CmdError = fmt.Errorf("remote command failed: %w", remoteRunErr)
+            h.ExitCode = exitCode(remoteRunErr)
+        default:
+            h.CmdError = nil
+            h.ExitCode = 0
+        }
+        if h.CmdError != nil && ctx.Err() != nil {
+            h.CmdError = ctx.Err()
+        }
+        if h.CmdError != nil {
+            return fmt.Sprintf("ERROR: Failed to pipe command on host %s to %s: %s", h.Name, localCmd, h.CmdError)
+        }
+        return fmt.Sprintf("INFO: completed piping host %s to %s", h.Name, localCmd)
+    })
+}
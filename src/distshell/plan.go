@@ -0,0 +1,318 @@
+package distshell
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "sort"
+    "time"
+)
+
+/*
+ *   A plan is the JSON form of a DistShell's hosts, commands and options written by SavePlan and read by LoadPlan
+ *   so a run can be reviewed, committed and applied later, possibly by another process.
+ *   Results are not part of a plan and neither are functions such as hooks, predicates or the Transport,
+ *   those must be set again after LoadPlan
+ */
+
+// planFile is the top level of a saved plan
+type planFile struct {
+    Hosts []planHost `json:"hosts"`
+    DefaultCommand string `json:"default_command,omitempty"`
+    DefaultArgs []string `json:"default_args,omitempty"`
+    Config planConfig `json:"config"`
+}
+
+// planHost is one host with its command chain
+type planHost struct {
+    Name string `json:"name"`
+    Command string `json:"command,omitempty"`
+    Args []string `json:"args,omitempty"`
+    Steps []planStep `json:"steps,omitempty"`
+    Vars map[string]string `json:"vars,omitempty"`
+    Meta map[string]string `json:"meta,omitempty"`
+    OutputRedirect string `json:"output_redirect,omitempty"`
+    Tags []string `json:"tags,omitempty"`
+    Weight int `json:"weight,omitempty"`
+    CommandTimeout string `json:"command_timeout,omitempty"`
+}
+
+// planStep is a command chained with AddCommandThen
+type planStep struct {
+    Command string `json:"command"`
+    Args []string `json:"args,omitempty"`
+    OnSuccess bool `json:"on_success"`
+}
+
+// planConfig holds the options set through the DistShell setters, durations are in time.Duration string form
+type planConfig struct {
+    Monitor bool `json:"monitor"`
+    MaxBatch int `json:"max_batch"`
+    AdaptiveMin int `json:"adaptive_min,omitempty"`
+    AdaptiveMax int `json:"adaptive_max,omitempty"`
+    Retries int `json:"retries,omitempty"`
+    RetryableExitCodes []int `json:"retryable_exit_codes,omitempty"`
+    FailureThreshold float64 `json:"failure_threshold,omitempty"`
+    IgnoreConnectErrors bool `json:"ignore_connect_errors,omitempty"`
+    ErrorOnNoHosts bool `json:"error_on_no_hosts,omitempty"`
+    ConcurrencyBudget int `json:"concurrency_budget,omitempty"`
+    OverallTimeout string `json:"overall_timeout,omitempty"`
+    CommandTimeout string `json:"command_timeout,omitempty"`
+    AllowedCommands []string `json:"allowed_commands,omitempty"`
+    User string `json:"user,omitempty"`
+    Port int `json:"port,omitempty"`
+    HostKeyPolicy string `json:"host_key_policy,omitempty"`
+    BatchMode *bool `json:"batch_mode,omitempty"`
+    RequestTTY bool `json:"request_tty,omitempty"`
+    SSHOptions map[string]string `json:"ssh_options,omitempty"`
+    SSHConfigFile string `json:"ssh_config_file,omitempty"`
+    BindAddress string `json:"bind_address,omitempty"`
+    Compression bool `json:"compression,omitempty"`
+    CaptureRemotePID bool `json:"capture_remote_pid,omitempty"`
+    DiscardOutput bool `json:"discard_output,omitempty"`
+    DedupeOutputLines bool `json:"dedupe_output_lines,omitempty"`
+    NormalizeLineEndings bool `json:"normalize_line_endings,omitempty"`
+    RingBufferSize int `json:"ring_buffer_size,omitempty"`
+    StderrTail int `json:"stderr_tail"`
+    Nice *int `json:"nice,omitempty"`
+    IONiceClass int `json:"ionice_class,omitempty"`
+    IONiceLevel int `json:"ionice_level,omitempty"`
+    Detached bool `json:"detached,omitempty"`
+    RemoteCommandAsSingleString bool `json:"remote_command_as_single_string,omitempty"`
+    UseSFTP bool `json:"use_sftp,omitempty"`
+    SCPQuiet bool `json:"scp_quiet"`
+    History bool `json:"history,omitempty"`
+    MaxHistory int `json:"max_history"`
+    Templating bool `json:"templating,omitempty"`
+    WarnOnOverwrite bool `json:"warn_on_overwrite,omitempty"`
+    OutputFlushInterval string `json:"output_flush_interval,omitempty"`
+    MaxOutputRate int `json:"max_output_rate,omitempty"`
+    MeasureConnectTime bool `json:"measure_connect_time,omitempty"`
+    ParseJSONLines bool `json:"parse_json_lines,omitempty"`
+    ChecksumOutput bool `json:"checksum_output,omitempty"`
+    SortFailedHosts bool `json:"sort_failed_hosts,omitempty"`
+    PrefixOutput bool `json:"prefix_output,omitempty"`
+    ResultBufferSize int `json:"result_buffer_size,omitempty"`
+}
+
+// SavePlan writes the hosts, their commands and the DistShell's options to w as JSON
+// A DistShell holding an invalid With value is not saved, its ConfigError is returned
+func (ds *DistShell) SavePlan(w io.Writer) error {
+    if ds.configErr != nil {
+        return ds.configErr
+    }
+    p := planFile{
+        Hosts: make([]planHost, len(ds.HOSTS)),
+        DefaultCommand: ds.defaultCmd,
+        DefaultArgs: ds.defaultArgs,
+        Config: planConfig{
+            Monitor: ds.monitor,
+            MaxBatch: ds.maxBatch,
+            AdaptiveMin: ds.adaptiveMin,
+            AdaptiveMax: ds.adaptiveMax,
+            Retries: ds.retries,
+            FailureThreshold: ds.failureThreshold,
+            IgnoreConnectErrors: ds.ignoreConnectErrors,
+            ErrorOnNoHosts: ds.errorOnNoHosts,
+            ConcurrencyBudget: ds.concurrencyBudget,
+            User: ds.user,
+            Port: ds.port,
+            HostKeyPolicy: ds.hostKeyPolicy,
+            BatchMode: &ds.batchMode,
+            RequestTTY: ds.requestTTY,
+            SSHOptions: ds.sshExtraOptions,
+            SSHConfigFile: ds.sshConfigFile,
+            BindAddress: ds.bindAddress,
+            Compression: ds.compression,
+            CaptureRemotePID: ds.captureRemotePID,
+            DiscardOutput: ds.discardOutput,
+            DedupeOutputLines: ds.dedupeLines,
+            NormalizeLineEndings: ds.normalizeLineEndings,
+            RingBufferSize: ds.ringSize,
+            StderrTail: ds.stderrTail,
+            Nice: ds.nice,
+            IONiceClass: ds.ioniceClass,
+            IONiceLevel: ds.ioniceLevel,
+            Detached: ds.detached,
+            RemoteCommandAsSingleString: ds.remoteSingleString,
+            UseSFTP: ds.useSFTP,
+            SCPQuiet: ds.scpQuiet,
+            History: ds.history,
+            MaxHistory: ds.maxHistory,
+            Templating: ds.templating,
+            WarnOnOverwrite: ds.warnOnOverwrite,
+            MaxOutputRate: ds.maxOutputRate,
+            MeasureConnectTime: ds.measureConnect,
+            ParseJSONLines: ds.parseJSONLines,
+            ChecksumOutput: ds.checksumOutput,
+            SortFailedHosts: ds.sortFailedHosts,
+            PrefixOutput: ds.prefixOutput,
+            ResultBufferSize: ds.resultBufferSize,
+        },
+    }
+    if ds.overallTimeout > 0 {
+        p.Config.OverallTimeout = ds.overallTimeout.String()
+    }
+    if ds.cmdTimeout > 0 {
+        p.Config.CommandTimeout = ds.cmdTimeout.String()
+    }
+    if ds.flushInterval > 0 {
+        p.Config.OutputFlushInterval = ds.flushInterval.String()
+    }
+    for cmd := range ds.allowedCommands {
+        p.Config.AllowedCommands = append(p.Config.AllowedCommands, cmd)
+    }
+    sort.Strings(p.Config.AllowedCommands)
+    for code := range ds.retryableExitCodes {
+        p.Config.RetryableExitCodes = append(p.Config.RetryableExitCodes, code)
+    }
+    sort.Ints(p.Config.RetryableExitCodes)
+
+    for i := range ds.HOSTS {
+        h := &ds.HOSTS[i]
+        p.Hosts[i] = planHost{Name: h.Name, Command: h.cmd, Args: h.args, Vars: h.vars, Meta: h.Meta, OutputRedirect: h.redirect, Tags: h.tags, Weight: h.weight}
+        if h.timeout > 0 {
+            p.Hosts[i].CommandTimeout = h.timeout.String()
+        }
+        for s := range h.steps {
+            p.Hosts[i].Steps = append(p.Hosts[i].Steps, planStep{Command: h.steps[s].cmd, Args: h.steps[s].args, OnSuccess: h.steps[s].onSuccess})
+        }
+    }
+
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "  ")
+    return enc.Encode(p)
+}
+
+// LoadPlan reads a plan written by SavePlan and returns a DistShell ready to Execute
+// Options are applied through their setters so invalid values are reported as errors
+func LoadPlan(r io.Reader) (*DistShell, error) {
+    var p planFile
+    if err := json.NewDecoder(r).Decode(&p); err != nil {
+        return nil, fmt.Errorf("unable to decode plan: %s", err)
+    }
+
+    // host names in a plan are already expanded so they are not run through buildHost again
+    ds := New(nil)
+    for i := range p.Hosts {
+        if p.Hosts[i].Name == "" {
+            return nil, fmt.Errorf("plan host %d has no name", i)
+        }
+        ds.HOSTS = append(ds.HOSTS, Host{Name: p.Hosts[i].Name, cmd: p.Hosts[i].Command, args: p.Hosts[i].Args,
+            vars: p.Hosts[i].Vars, Meta: p.Hosts[i].Meta, redirect: p.Hosts[i].OutputRedirect, tags: p.Hosts[i].Tags, weight: p.Hosts[i].Weight})
+        h := &ds.HOSTS[len(ds.HOSTS)-1]
+        if p.Hosts[i].CommandTimeout != "" {
+            d, err := time.ParseDuration(p.Hosts[i].CommandTimeout)
+            if err != nil || d < 0 {
+                return nil, fmt.Errorf("invalid command timeout %q for plan host %s", p.Hosts[i].CommandTimeout, h.Name)
+            }
+            h.timeout = d
+        }
+        for _, step := range p.Hosts[i].Steps {
+            h.steps = append(h.steps, commandStep{cmd: step.Command, args: step.Args, onSuccess: step.OnSuccess})
+        }
+    }
+    ds.SetDefaultCommand(p.DefaultCommand, p.DefaultArgs...)
+
+    if err := ds.applyPlanConfig(p.Config); err != nil {
+        return nil, err
+    }
+    return ds, nil
+}
+
+// applyPlanConfig sets the options of a loaded plan
+func (ds *DistShell) applyPlanConfig(c planConfig) error {
+    ds.monitor = c.Monitor
+    if c.MaxBatch < 1 {
+        return fmt.Errorf("invalid max batch %d in plan", c.MaxBatch)
+    }
+    ds.SetMaxBatch(c.MaxBatch)
+    if c.AdaptiveMax > 0 {
+        ds.SetAdaptiveBatch(c.AdaptiveMin, c.AdaptiveMax)
+    }
+    ds.SetRetries(c.Retries)
+    ds.SetRetryableExitCodes(c.RetryableExitCodes)
+    ds.SetFailureThreshold(c.FailureThreshold)
+    ds.SetIgnoreConnectErrors(c.IgnoreConnectErrors)
+    ds.SetErrorOnNoHosts(c.ErrorOnNoHosts)
+    ds.SetConcurrencyBudget(c.ConcurrencyBudget)
+    if c.OverallTimeout != "" {
+        d, err := time.ParseDuration(c.OverallTimeout)
+        if err != nil {
+            return fmt.Errorf("invalid overall timeout in plan: %s", err)
+        }
+        ds.SetOverallTimeout(d)
+    }
+    if c.CommandTimeout != "" {
+        d, err := time.ParseDuration(c.CommandTimeout)
+        if err != nil {
+            return fmt.Errorf("invalid command timeout in plan: %s", err)
+        }
+        if err := ds.SetCommandTimeout(d); err != nil {
+            return err
+        }
+    }
+    ds.SetAllowedCommands(c.AllowedCommands)
+    if err := ds.SetUser(c.User); err != nil {
+        return err
+    }
+    if err := ds.SetPort(c.Port); err != nil {
+        return err
+    }
+    if c.HostKeyPolicy != "" {
+        if err := ds.SetHostKeyPolicy(c.HostKeyPolicy); err != nil {
+            return err
+        }
+    }
+    ds.SetRequestTTY(c.RequestTTY)
+    if c.BatchMode != nil {
+        ds.SetBatchMode(*c.BatchMode)
+    }
+    if err := ds.SetSSHOptions(c.SSHOptions); err != nil {
+        return err
+    }
+    ds.SetSSHConfigFile(c.SSHConfigFile)
+    if err := ds.SetBindAddress(c.BindAddress); err != nil {
+        return err
+    }
+    ds.SetCompression(c.Compression)
+    ds.SetCaptureRemotePID(c.CaptureRemotePID)
+    ds.SetDiscardOutput(c.DiscardOutput)
+    ds.SetDedupeOutputLines(c.DedupeOutputLines)
+    ds.SetNormalizeLineEndings(c.NormalizeLineEndings)
+    ds.SetRingBufferSize(c.RingBufferSize)
+    ds.SetFailureStderrTail(c.StderrTail)
+    if c.Nice != nil {
+        if err := ds.SetNice(*c.Nice); err != nil {
+            return err
+        }
+    }
+    if c.IONiceClass != 0 {
+        if err := ds.SetIONice(c.IONiceClass, c.IONiceLevel); err != nil {
+            return err
+        }
+    }
+    ds.SetDetached(c.Detached)
+    ds.SetRemoteCommandAsSingleString(c.RemoteCommandAsSingleString)
+    ds.SetUseSFTP(c.UseSFTP)
+    ds.SetSCPQuiet(c.SCPQuiet)
+    ds.EnableHistory(c.History)
+    ds.SetMaxHistory(c.MaxHistory)
+    ds.SetTemplating(c.Templating)
+    ds.SetWarnOnOverwrite(c.WarnOnOverwrite)
+    if c.OutputFlushInterval != "" {
+        d, err := time.ParseDuration(c.OutputFlushInterval)
+        if err != nil {
+            return fmt.Errorf("invalid output flush interval in plan: %s", err)
+        }
+        ds.SetOutputFlushInterval(d)
+    }
+    ds.SetMaxOutputRate(c.MaxOutputRate)
+    ds.SetMeasureConnectTime(c.MeasureConnectTime)
+    ds.SetParseJSONLines(c.ParseJSONLines)
+    ds.SetChecksumOutput(c.ChecksumOutput)
+    ds.SetSortFailedHosts(c.SortFailedHosts)
+    ds.SetPrefixOutput(c.PrefixOutput)
+    ds.SetResultBufferSize(c.ResultBufferSize)
+    return nil
+}
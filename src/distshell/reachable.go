@@ -0,0 +1,115 @@
+package distshell
+
+import (
+    "context"
+    "io"
+    "sync"
+    "time"
+)
+
+// pingTimeout bounds a single reachability check
+const pingTimeout = 10 * time.Second
+
+// defaultPingInterval is how often WaitReachable pings when given an interval that is not positive
+const defaultPingInterval = 5 * time.Second
+
+// Ping checks every host is reachable by running true over ssh, or the configured Transport, and returns
+// the result per host.  Up to the batch size hosts are checked at once.  Host results from Execute are not touched
+func (ds *DistShell) Ping() map[string]bool {
+    return ds.PingContext(context.Background())
+}
+
+// PingContext is Ping bound to ctx
+func (ds *DistShell) PingContext(ctx context.Context) map[string]bool {
+    names := make([]string, len(ds.HOSTS))
+    for i := range ds.HOSTS {
+        names[i] = ds.HOSTS[i].Name
+    }
+    return ds.ping(ctx, names)
+}
+
+// WaitReachable pings the hosts every interval until all of them are reachable or ctx expires and returns
+// the final reachability of each host.  A host stays reachable once it has answered, which suits waiting
+// for a fleet to come back after a reboot.  An interval of 0 or less uses 5 seconds
+func (ds *DistShell) WaitReachable(ctx context.Context, interval time.Duration) map[string]bool {
+    if interval <= 0 {
+        interval = defaultPingInterval
+    }
+    reachable := make(map[string]bool)
+    for i := range ds.HOSTS {
+        reachable[ds.HOSTS[i].Name] = false
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        waiting := make([]string, 0)
+        for name, ok := range reachable {
+            if !ok {
+                waiting = append(waiting, name)
+            }
+        }
+        if len(waiting) == 0 {
+            return reachable
+        }
+        for name, ok := range ds.ping(ctx, waiting) {
+            reachable[name] = ok
+        }
+        select {
+        case <-ctx.Done():
+            return reachable
+        case <-ticker.C:
+        }
+    }
+}
+
+// ping checks the named hosts concurrently, at most maxBatch at a time
+func (ds *DistShell) ping(ctx context.Context, names []string) map[string]bool {
+    // without ssh in $PATH SSH stays empty and no host is reachable
+    SSH := ""
+    if ds.transport == nil {
+        SSH, _ = lookPath("ssh")
+    }
+    var mu sync.Mutex
+    results := make(map[string]bool)
+    ds.eachHost(names, func(name string) {
+        ok := ds.pingHost(ctx, SSH, name)
+        mu.Lock()
+        results[name] = ok
+        mu.Unlock()
+    })
+    return results
+}
+
+// eachHost calls fn for every name concurrently, at most maxBatch at a time, and waits for them all
+func (ds *DistShell) eachHost(names []string, fn func(name string)) {
+    batchSize := ds.maxBatch
+    if batchSize < 1 {
+        batchSize = 1
+    }
+    var wg sync.WaitGroup
+    limit := make(chan struct{}, batchSize)
+    for i := range names {
+        wg.Add(1)
+        limit <- struct{}{}
+        go func(name string) {
+            defer wg.Done()
+            defer func() { <-limit }()
+            fn(name)
+        }(names[i])
+    }
+    wg.Wait()
+}
+
+// pingHost reports whether true runs successfully on the host
+func (ds *DistShell) pingHost(ctx context.Context, SSH string, name string) bool {
+    ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+    defer cancel()
+    if ds.transport != nil {
+        return ds.transport.Run(ctx, ds.target(name), []string{"true"}, io.Discard, io.Discard) == nil
+    }
+    if SSH == "" {
+        return false
+    }
+    cmdArgs := append(ds.sshOptions(), ds.target(name), "true")
+    return execCommandContext(ctx, SSH, cmdArgs...).Run() == nil
+}
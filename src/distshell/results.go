@@ -0,0 +1,326 @@
+package distshell
+
+import (
+    "bytes"
+    "encoding/csv"
+    "errors"
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+    "math"
+    "regexp"
+    "sort"
+    "syscall"
+    "time"
+)
+
+// defaultMaxHistory is the number of runs kept once history is enabled
+const defaultMaxHistory = 10
+
+// HostResult is a snapshot of a single host's outcome from a run
+type HostResult struct {
+    Name string
+    Stdout []byte
+    Stderr []byte
+    Error error
+    ExitCode int
+    Signal syscall.Signal
+    RemotePID int
+    OutputBytes int64
+    Attempts int // tries the host needed, see SetRetries
+    Status HostStatus
+    Skipped bool // the host never started because the run ended early
+    SkipReason string // why the host was skipped, one of the Skip constants
+    StartedAt time.Time
+    FinishedAt time.Time
+    Duration time.Duration
+    ConnectDuration time.Duration
+    OutputChecksum string
+    Meta map[string]string
+    Steps []StepResult
+}
+
+// result returns a snapshot of the host's current outcome
+func (h *Host) result() HostResult {
+    return HostResult{
+        Name: h.Name,
+        Stdout: h.Stdout,
+        Stderr: h.Stderr,
+        Error: h.CmdError,
+        ExitCode: h.ExitCode,
+        Signal: h.Signal,
+        RemotePID: h.RemotePID,
+        OutputBytes: h.OutputBytes,
+        Attempts: h.Attempts,
+        Status: h.getStatus(),
+        Skipped: h.SkipReason != "",
+        SkipReason: h.SkipReason,
+        StartedAt: h.StartedAt,
+        FinishedAt: h.FinishedAt,
+        Duration: h.FinishedAt.Sub(h.StartedAt),
+        ConnectDuration: h.ConnectDuration,
+        OutputChecksum: h.OutputChecksum,
+        Meta: copyMeta(h.Meta),
+        Steps: h.StepResults,
+    }
+}
+
+// copyMeta copies a host's metadata so a result is not changed by later SetHostMeta calls
+func copyMeta(meta map[string]string) map[string]string {
+    if meta == nil {
+        return nil
+    }
+    c := make(map[string]string, len(meta))
+    for k, v := range meta {
+        c[k] = v
+    }
+    return c
+}
+
+// Results returns the outcome of every host that took part in the most recent run
+func (ds *DistShell) Results() []HostResult {
+    results := make([]HostResult, len(ds.results))
+    copy(results, ds.results)
+    return results
+}
+
+// ResultsWhere returns the results of the most recent run for which pred returns true
+func (ds *DistShell) ResultsWhere(pred func(HostResult) bool) []HostResult {
+    results := make([]HostResult, 0)
+    for i := range ds.results {
+        if pred(ds.results[i]) {
+            results = append(results, ds.results[i])
+        }
+    }
+    return results
+}
+
+// HostsMatching returns the names of the hosts whose stdout from the most recent run matches re
+func (ds *DistShell) HostsMatching(re *regexp.Regexp) []string {
+    names := make([]string, 0)
+    for i := range ds.results {
+        if re.Match(ds.results[i].Stdout) {
+            names = append(names, ds.results[i].Name)
+        }
+    }
+    return names
+}
+
+// CountMatching returns the number of hosts whose stdout from the most recent run matches re
+func (ds *DistShell) CountMatching(re *regexp.Regexp) int {
+    return len(ds.HostsMatching(re))
+}
+
+// GroupByOutput groups the hosts of the most recent run by identical stdout
+// The map key is the output and the value the host names that produced it, in host order
+func (ds *DistShell) GroupByOutput() map[string][]string {
+    groups := make(map[string][]string)
+    for i := range ds.results {
+        out := string(ds.results[i].Stdout)
+        groups[out] = append(groups[out], ds.results[i].Name)
+    }
+    return groups
+}
+
+// ChecksumGroups groups the hosts of the most recent run by the checksum of their stdout, see SetChecksumOutput
+// A single key means every host produced the same output.  Hosts without a checksum, such as skipped hosts, are left out
+func (ds *DistShell) ChecksumGroups() map[string][]string {
+    groups := make(map[string][]string)
+    for i := range ds.results {
+        if sum := ds.results[i].OutputChecksum; sum != "" {
+            groups[sum] = append(groups[sum], ds.results[i].Name)
+        }
+    }
+    return groups
+}
+
+// SumOutputs parses the trimmed stdout of every host that succeeded in the most recent run as a number and returns
+// the total, such as free bytes across a fleet.  Hosts that failed or printed something else are named in the error
+// and left out of the total, which still covers the others
+func (ds *DistShell) SumOutputs() (float64, error) {
+    values, err := ds.numericOutputs()
+    total := 0.0
+    for _, v := range values {
+        total += v
+    }
+    return total, err
+}
+
+// AvgOutputs is SumOutputs averaged over the hosts whose output was a number
+func (ds *DistShell) AvgOutputs() (float64, error) {
+    values, err := ds.numericOutputs()
+    if len(values) == 0 {
+        if err == nil {
+            err = errors.New("no host output to average")
+        }
+        return 0, err
+    }
+    total := 0.0
+    for _, v := range values {
+        total += v
+    }
+    return total / float64(len(values)), err
+}
+
+// numericOutputs returns the numbers printed by the hosts of the most recent run and an error naming those without one
+func (ds *DistShell) numericOutputs() ([]float64, error) {
+    values := make([]float64, 0, len(ds.results))
+    bad := make([]string, 0)
+    for i := range ds.results {
+        r := ds.results[i]
+        if r.Error != nil || r.Skipped {
+            bad = append(bad, r.Name + " (failed)")
+            continue
+        }
+        v, err := strconv.ParseFloat(strings.TrimSpace(string(r.Stdout)), 64)
+        if err != nil {
+            bad = append(bad, fmt.Sprintf("%s (%q is not a number)", r.Name, strings.TrimSpace(string(r.Stdout))))
+            continue
+        }
+        values = append(values, v)
+    }
+    if len(bad) > 0 {
+        return values, errors.New("hosts without a numeric output: " + strings.Join(bad, ", "))
+    }
+    return values, nil
+}
+
+// csvPreviewBytes is how much of each host's stdout WriteResultsCSV includes
+const csvPreviewBytes = 200
+
+// WriteResultsCSV writes the results of the most recent run as CSV with a header row and one row per host:
+// host, exit_code, duration_ms, error and the first 200 bytes of stdout.  Fields are quoted as needed so output
+// containing commas, quotes or newlines stays in one cell
+func (ds *DistShell) WriteResultsCSV(w io.Writer) error {
+    cw := csv.NewWriter(w)
+    cw.Write([]string{"host", "exit_code", "duration_ms", "error", "stdout"})
+    for i := range ds.results {
+        r := ds.results[i]
+        errString := ""
+        if r.Error != nil {
+            errString = r.Error.Error()
+        } else if r.SkipReason != "" {
+            errString = "skipped: " + r.SkipReason
+        }
+        cw.Write([]string{r.Name, strconv.Itoa(r.ExitCode), strconv.FormatInt(r.Duration.Milliseconds(), 10), errString, stdoutPreview(r.Stdout)})
+    }
+    cw.Flush()
+    return cw.Error()
+}
+
+// stdoutPreview returns the start of out as valid UTF-8, cut on a rune boundary
+func stdoutPreview(out []byte) string {
+    if len(out) > csvPreviewBytes {
+        cut := csvPreviewBytes
+        for cut > 0 && !utf8.RuneStart(out[cut]) {
+            cut -= 1
+        }
+        out = out[:cut]
+    }
+    return strings.ToValidUTF8(string(out), "\uFFFD")
+}
+
+// Stats summarizes the command durations of a run
+type Stats struct {
+    Count int // hosts whose command ran to completion or failure, skipped hosts are not counted
+    Min time.Duration
+    Max time.Duration
+    Median time.Duration
+    P95 time.Duration
+}
+
+// TimingStats returns the distribution of command durations across the hosts of the most recent run
+func (ds *DistShell) TimingStats() Stats {
+    durations := make([]time.Duration, 0, len(ds.results))
+    for i := range ds.results {
+        if !ds.results[i].StartedAt.IsZero() && !ds.results[i].FinishedAt.IsZero() {
+            durations = append(durations, ds.results[i].Duration)
+        }
+    }
+    if len(durations) == 0 {
+        return Stats{}
+    }
+    sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+    n := len(durations)
+    stats := Stats{Count: n, Min: durations[0], Max: durations[n-1]}
+    if n % 2 == 1 {
+        stats.Median = durations[n/2]
+    } else {
+        stats.Median = (durations[n/2-1] + durations[n/2]) / 2
+    }
+    // nearest rank, so the p95 is always a duration some host actually took
+    rank := int(math.Ceil(0.95 * float64(n)))
+    stats.P95 = durations[rank-1]
+    return stats
+}
+
+// EnableHistory keeps the Results of each run so they can be compared with History
+// Only the most recent runs are kept, see SetMaxHistory
+func (ds *DistShell) EnableHistory(enable bool) {
+    ds.history = enable
+    if !enable {
+        ds.runHistory = nil
+    }
+}
+
+// SetMaxHistory sets how many runs History keeps, values below 1 keep only the last run.  Default is 10
+func (ds *DistShell) SetMaxHistory(n int) {
+    if n < 1 {
+        n = 1
+    }
+    ds.maxHistory = n
+    ds.trimHistory()
+}
+
+// History returns the results of previous runs, oldest first
+func (ds *DistShell) History() [][]HostResult {
+    history := make([][]HostResult, len(ds.runHistory))
+    copy(history, ds.runHistory)
+    return history
+}
+
+// recordResults snapshots the given hosts as the results of the run that just finished
+func (ds *DistShell) recordResults(hosts []*Host) {
+    ds.results = make([]HostResult, len(hosts))
+    for i := range hosts {
+        ds.results[i] = hosts[i].result()
+    }
+    if ds.history {
+        ds.runHistory = append(ds.runHistory, ds.results)
+        ds.trimHistory()
+    }
+}
+
+// trimHistory drops the oldest runs beyond maxHistory
+func (ds *DistShell) trimHistory() {
+    if len(ds.runHistory) > ds.maxHistory {
+        ds.runHistory = ds.runHistory[len(ds.runHistory)-ds.maxHistory:]
+    }
+}
+
+// DiffRuns compares two sets of results and returns the before and after stdout of every host whose output changed
+// A host present in only one of the runs is included with nil output for the run it is missing from
+func DiffRuns(before, after []HostResult) map[string][2][]byte {
+    diff := make(map[string][2][]byte)
+    previous := make(map[string][]byte, len(before))
+    for i := range before {
+        previous[before[i].Name] = before[i].Stdout
+    }
+    seen := make(map[string]bool, len(after))
+    for i := range after {
+        seen[after[i].Name] = true
+        old, ok := previous[after[i].Name]
+        if !ok || !bytes.Equal(old, after[i].Stdout) {
+            diff[after[i].Name] = [2][]byte{old, after[i].Stdout}
+        }
+    }
+    for i := range before {
+        if !seen[before[i].Name] {
+            diff[before[i].Name] = [2][]byte{before[i].Stdout, nil}
+        }
+    }
+    return diff
+}
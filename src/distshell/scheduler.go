@@ -0,0 +1,651 @@
+package distshell
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+)
+
+// ErrThresholdExceeded is returned when a run is aborted by SetFailureThreshold
+var ErrThresholdExceeded = errors.New("failure threshold exceeded")
+
+// ErrAlreadyRunning is returned when a run is started while another run on the same DistShell is in progress
+var ErrAlreadyRunning = errors.New("a run is already in progress")
+
+// ErrOverallTimeout is returned when a run is cut short by SetOverallTimeout
+var ErrOverallTimeout = errors.New("overall run timeout exceeded")
+
+// ErrDrained is returned by a run that Drain stopped before every host was started
+var ErrDrained = errors.New("run drained")
+
+// ErrNoHosts is returned when SetErrorOnNoHosts is on and a run targets no hosts
+var ErrNoHosts = errors.New("no hosts targeted")
+
+// connectErrorExitCode is the status ssh exits with when it cannot reach or authenticate to a host
+const connectErrorExitCode = 255
+
+// thresholdMinSample is the number of completed hosts needed before the failure threshold is checked
+const thresholdMinSample = 5
+
+// hostDoneFunc is told about every host as the run collects it, final is false while the host may still be retried
+// It is passed to runBatch through the context under hostDoneKey so it only applies to that run
+type hostDoneFunc func(h *Host, final bool)
+
+type hostDoneKey struct{}
+
+// runClaimedKey marks a context whose run already holds the running flag, see claimRun
+type runClaimedKey struct{}
+
+// claimRun takes the running flag before calling fn, so the commands fn assigns cannot be read by another run
+// starting in between.  runBatch called with the context fn is given runs without taking the flag again
+func (ds *DistShell) claimRun(ctx context.Context, fn func(ctx context.Context) error) error {
+    if !ds.running.CompareAndSwap(false, true) {
+        return ErrAlreadyRunning
+    }
+    defer ds.running.Store(false)
+    return fn(context.WithValue(ctx, runClaimedKey{}, true))
+}
+
+// hostObserver is told about every host as it completes, it backs the optional prometheus metrics
+type hostObserver interface {
+    observe(h *Host, failed bool)
+}
+
+// hostReport is sent by each host's go routine when its work completes
+type hostReport struct {
+    h *Host
+    msg string
+}
+
+// runBatch runs work against the given hosts, at most maxBatch at a time, and returns the hosts that failed
+// work is run in its own go routine per host and returns the status message for the host
+func (ds *DistShell) runBatch(ctx context.Context, hosts []*Host, work func(ctx context.Context, h *Host) string) error {
+    if ds.configErr != nil {
+        return ds.configErr
+    }
+    if len(hosts) == 0 && ds.errorOnNoHosts {
+        return ErrNoHosts
+    }
+    if ctx.Value(runClaimedKey{}) == nil {
+        if !ds.running.CompareAndSwap(false, true) {
+            return ErrAlreadyRunning
+        }
+        defer ds.running.Store(false)
+    }
+
+    // Drain waits on runDone, it is closed once every host has reported
+    done := make(chan struct{})
+    ds.inflightMu.Lock()
+    ds.runDone = done
+    ds.cancelledHosts = make(map[string]bool)
+    ds.inflightMu.Unlock()
+    defer func() {
+        ds.inflightMu.Lock()
+        ds.runDone = nil
+        ds.inflightMu.Unlock()
+        ds.draining.Store(false)
+        close(done)
+    }()
+
+    // the cancel cause tells skipped hosts why the run ended early
+    runCtx, cancel := context.WithCancelCause(ctx)
+    defer cancel(nil)
+    ds.inflightMu.Lock()
+    ds.runCancel = cancel
+    ds.inflightMu.Unlock()
+    defer func() {
+        ds.inflightMu.Lock()
+        ds.runCancel = nil
+        ds.inflightMu.Unlock()
+    }()
+    if ds.overallTimeout > 0 {
+        var cancelTimeout context.CancelFunc
+        runCtx, cancelTimeout = context.WithTimeoutCause(runCtx, ds.overallTimeout, ErrOverallTimeout)
+        defer cancelTimeout()
+    }
+
+    cmdStatus := make(chan hostReport, ds.maxBatch)
+    batch := ds.newBatchSizer()
+    waveStart := time.Now()
+    waveFailed := 0
+    runningCount := 0
+    runningWeight := 0
+    completed := 0
+    failed := 0
+    exceeded := false
+    attempt := 1
+    minSample := thresholdMinSample
+    if len(hosts) < minSample {
+        minSample = len(hosts)
+    }
+
+    throttle := &statusThrottle{interval: ds.flushInterval, last: time.Now()}
+    hostDone, _ := ctx.Value(hostDoneKey{}).(hostDoneFunc)
+
+    // grab status for all running commands before starting the next batch
+    collect := func() {
+        for c := 0; c < runningCount; c++ {
+            s := <-cmdStatus
+            completed += 1
+            hostFailed := ds.hostFailed(s.h)
+            if hostFailed {
+                failed += 1
+                waveFailed += 1
+            }
+            if ds.monitor {
+                if throttle.interval <= 0 {
+                    fmt.Fprintln(ds.output(), ds.mask(s.msg))
+                } else if line := throttle.add(hostFailed); line != "" {
+                    fmt.Fprintln(ds.output(), line)
+                }
+            }
+            if ds.metrics != nil {
+                ds.metrics.observe(s.h, hostFailed)
+            }
+            if hostDone != nil {
+                // a failed host may still be retried
+                hostDone(s.h, attempt > ds.retries || !ds.retryable(s.h))
+            }
+            // the threshold judges the first pass only, retries would count the same host twice
+            if attempt == 1 && ds.failureThreshold > 0 && !exceeded && completed >= minSample &&
+                float64(failed) * 100 / float64(completed) > ds.failureThreshold {
+                exceeded = true
+                cancel(ErrThresholdExceeded)
+            }
+        }
+        if runningCount > 0 {
+            batch.adjust(time.Since(waveStart), runningCount, waveFailed)
+        }
+        runningCount = 0
+        runningWeight = 0
+        waveFailed = 0
+        waveStart = time.Now()
+    }
+
+    // start work for each host, grabbing statuses whenever a full batch is running
+    launch := func(pending []*Host) {
+        for i := range pending {
+            // a host that would go over the budget waits for the next wave, one heavier than the budget runs alone
+            if ds.concurrencyBudget > 0 && runningCount > 0 && runningWeight + pending[i].cost() > ds.concurrencyBudget {
+                collect()
+            }
+            if ds.hostCancelled(pending[i].Name) {
+                if pending[i].Attempts == 0 {
+                    pending[i].SkipReason = SkipCancelled
+                    pending[i].setStatus(Skipped)
+                    ds.emitStatus(ctx, pending[i], "INFO: skipped host " + pending[i].Name + ", " + SkipCancelled)
+                    if hostDone != nil {
+                        hostDone(pending[i], true)
+                    }
+                }
+                continue
+            }
+            if runCtx.Err() != nil || ds.draining.Load() {
+                // a host that already ran keeps its previous result
+                if pending[i].Attempts == 0 {
+                    pending[i].SkipReason = ds.skipReason(runCtx)
+                    pending[i].setStatus(Skipped)
+                    ds.emitStatus(ctx, pending[i], "INFO: skipped host " + pending[i].Name + ", " + pending[i].SkipReason)
+                    if hostDone != nil {
+                        hostDone(pending[i], true)
+                    }
+                }
+                continue
+            }
+            pending[i].Attempts += 1
+            go func(h *Host) {
+                status := hostReport{h: h}
+                if !ds.acquireShared(runCtx) {
+                    // the host never got to run so this try does not count
+                    h.Attempts -= 1
+                    if h.Attempts == 0 {
+                        h.SkipReason = ds.skipReason(runCtx)
+                        h.setStatus(Skipped)
+                    }
+                    status.msg = fmt.Sprintf("INFO: skipped host %s, the run ended while waiting for the shared limiter", h.Name)
+                    ds.emitStatus(ctx, h, status.msg)
+                    cmdStatus <- status
+                    return
+                }
+                defer ds.releaseShared()
+                hostCtx, hostCancel := context.WithCancel(runCtx)
+                defer hostCancel()
+                ds.startInFlight(h.Name, hostCancel)
+                h.setStatus(Running)
+                ds.emitStatus(ctx, h, "INFO: started host " + h.Name)
+                // a panic in work must still produce a status or the batch below waits forever
+                defer func() {
+                    if r := recover(); r != nil {
+                        h.CmdError = fmt.Errorf("panic while running host %s: %v", h.Name, r)
+                        status.msg = fmt.Sprintf("ERROR: recovered from panic on host %s: %v", h.Name, r)
+                    }
+                    h.finishStatus()
+                    ds.emitStatus(ctx, h, status.msg)
+                    ds.finishInFlight(h.Name)
+                    cmdStatus <- status
+                }()
+                h.CmdError = nil
+                status.msg = work(hostCtx, h)
+            }(pending[i])
+            runningCount += 1
+
+            runningWeight += pending[i].cost()
+            if runningCount >= batch.size || (ds.concurrencyBudget > 0 && runningWeight >= ds.concurrencyBudget) {
+                collect()
+            }
+        }
+        collect()
+    }
+
+    resetHosts(hosts)
+    pending := hosts
+    for {
+        launch(pending)
+        if attempt > ds.retries || runCtx.Err() != nil || ds.draining.Load() {
+            break
+        }
+        pending = ds.retryableHosts(pending)
+        if ds.hostRefresher != nil {
+            hosts, pending = ds.refreshHosts(hosts, pending)
+        }
+        if len(pending) == 0 {
+            break
+        }
+        attempt += 1
+        if ds.monitor {
+            fmt.Fprintf(ds.output(), "INFO: retrying %d failed hosts, attempt %d of %d\n", len(pending), attempt, ds.retries + 1)
+        }
+    }
+
+    if line := throttle.flush(); ds.monitor && line != "" {
+        fmt.Fprintln(ds.output(), line)
+    }
+    ds.recordResults(hosts)
+    err := ds.checkFailures(hosts)
+    if exceeded {
+        return ErrThresholdExceeded
+    }
+    if errors.Is(context.Cause(runCtx), ErrCancelled) {
+        return ErrCancelled
+    }
+    if ctx.Err() != nil {
+        return ctx.Err()
+    }
+    if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+        return ErrOverallTimeout
+    }
+    if ds.draining.Load() {
+        for i := range hosts {
+            if hosts[i].SkipReason == SkipDrained {
+                return ErrDrained
+            }
+        }
+    }
+    return err
+}
+
+// SetConcurrencyBudget limits each wave by the summed weight of its hosts' commands as well as by the batch size,
+// so a few heavy commands can run without starving or overloading the fleet.  See AddCommandWeighted.  Default is 0, no budget
+func (ds *DistShell) SetConcurrencyBudget(n int) {
+    ds.concurrencyBudget = n
+}
+
+// SetErrorOnNoHosts makes a run that targets no hosts, such as an empty shard or host list, return ErrNoHosts
+// instead of succeeding without doing anything.  Default is false
+func (ds *DistShell) SetErrorOnNoHosts(enable bool) {
+    ds.errorOnNoHosts = enable
+}
+
+// SetOverallTimeout caps the wall clock time of a whole run, 0 means no limit.  When it elapses in flight hosts
+// are cancelled, hosts not yet started are skipped and the run returns ErrOverallTimeout.  Results of the hosts
+// that completed are kept
+func (ds *DistShell) SetOverallTimeout(d time.Duration) {
+    ds.overallTimeout = d
+}
+
+// Drain stops the current run from starting any more hosts and blocks until the hosts already running
+// complete or ctx expires, in which case ctx.Err() is returned and the run carries on finishing in flight hosts.
+// Hosts that were never started are reported as skipped and the run returns ErrDrained.  Drain returns immediately
+// when nothing is running
+func (ds *DistShell) Drain(ctx context.Context) error {
+    ds.inflightMu.Lock()
+    done := ds.runDone
+    if done != nil {
+        ds.draining.Store(true)
+    }
+    ds.inflightMu.Unlock()
+    if done == nil {
+        return nil
+    }
+    select {
+    case <-done:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// SetSharedLimiter makes every host wait for a slot in sem before it runs, on top of the batch size
+// Give the same buffered channel to several DistShells to cap the number of commands they run at once, its capacity is the limit
+func (ds *DistShell) SetSharedLimiter(sem chan struct{}) {
+    ds.sharedLimiter = sem
+}
+
+// acquireShared takes a slot from the shared limiter, it returns false if ctx ends first
+func (ds *DistShell) acquireShared(ctx context.Context) bool {
+    if ds.sharedLimiter == nil {
+        return true
+    }
+    select {
+    case ds.sharedLimiter <- struct{}{}:
+        return true
+    case <-ctx.Done():
+        return false
+    }
+}
+
+// releaseShared returns a slot to the shared limiter
+func (ds *DistShell) releaseShared() {
+    if ds.sharedLimiter != nil {
+        <-ds.sharedLimiter
+    }
+}
+
+// SetOutputFlushInterval replaces the per host monitoring lines with a count of completed and failed hosts
+// written at most once per interval, which keeps very large runs from flooding the output.  0 writes every line
+func (ds *DistShell) SetOutputFlushInterval(d time.Duration) {
+    ds.flushInterval = d
+}
+
+// statusThrottle coalesces host completions into one summary line per interval
+type statusThrottle struct {
+    interval time.Duration
+    last time.Time
+    completed int
+    failed int
+}
+
+// add counts a completed host and returns a summary line once the interval has passed
+func (t *statusThrottle) add(failed bool) string {
+    t.completed += 1
+    if failed {
+        t.failed += 1
+    }
+    if time.Since(t.last) < t.interval {
+        return ""
+    }
+    return t.flush()
+}
+
+// flush returns the summary of the hosts counted since the last line and resets the counts
+func (t *statusThrottle) flush() string {
+    if t.completed == 0 {
+        return ""
+    }
+    line := fmt.Sprintf("INFO: %d completed, %d failed in last %s", t.completed, t.failed, time.Since(t.last).Round(time.Millisecond))
+    t.completed = 0
+    t.failed = 0
+    t.last = time.Now()
+    return line
+}
+
+// Reasons a host did not run, reported in Host.SkipReason and HostResult.SkipReason
+const (
+    SkipCancelled = "cancelled"
+    SkipThresholdExceeded = "failure threshold exceeded"
+    SkipOverallTimeout = "overall timeout"
+    SkipDrained = "drained"
+    SkipGone = "gone"
+)
+
+// skipReason explains why a host is being skipped in the run bound to runCtx
+func (ds *DistShell) skipReason(runCtx context.Context) string {
+    if runCtx.Err() == nil && ds.draining.Load() {
+        return SkipDrained
+    }
+    switch context.Cause(runCtx) {
+    case ErrThresholdExceeded:
+        return SkipThresholdExceeded
+    case ErrOverallTimeout:
+        return SkipOverallTimeout
+    }
+    return SkipCancelled
+}
+
+// retryableHosts returns the hosts that ran and failed in a way that may be retried
+func (ds *DistShell) retryableHosts(hosts []*Host) []*Host {
+    failed := make([]*Host, 0)
+    for i := range hosts {
+        if ds.retryable(hosts[i]) {
+            failed = append(failed, hosts[i])
+        }
+    }
+    return failed
+}
+
+// retryable reports whether the host failed and SetRetries should try it again
+func (ds *DistShell) retryable(h *Host) bool {
+    if !ds.hostFailed(h) || h.SkipReason != "" {
+        return false
+    }
+    return ds.retryableExitCodes == nil || ds.retryableExitCodes[h.ExitCode]
+}
+
+// SetRetryableExitCodes limits SetRetries to hosts whose command exited with one of codes, such as 75 (EX_TEMPFAIL)
+// for tools that tell transient failures from permanent ones.  Include 255 to also retry connection failures.
+// Hosts that failed without an exit code, such as on a timeout, are not retried.  nil or empty retries every failure
+func (ds *DistShell) SetRetryableExitCodes(codes []int) {
+    if len(codes) == 0 {
+        ds.retryableExitCodes = nil
+        return
+    }
+    ds.retryableExitCodes = make(map[int]bool, len(codes))
+    for _, code := range codes {
+        ds.retryableExitCodes[code] = true
+    }
+}
+
+/*
+ *   SetHostRefresher sets a function called before each retry round that returns the current host list, for fleets
+ *   such as autoscaling groups that change while a run is retrying.
+ *   Hosts it returns that are not yet known are added and run the command set by SetDefaultCommand, Execute fails
+ *   them if there is none.
+ *   Hosts of the run it no longer returns are not retried, they keep the output and CmdError of their last attempt
+ *   with SkipReason "gone" and do not count as failed.  Gone hosts stay in HOSTS so their results can be read
+ */
+func (ds *DistShell) SetHostRefresher(fn func() []string) {
+    ds.hostRefresher = fn
+}
+
+// refreshHosts applies the host refresher between retry rounds and returns the run's hosts and the hosts to retry
+// HOSTS may be reallocated so both lists are rebuilt to point into the new slice
+func (ds *DistShell) refreshHosts(hosts []*Host, pending []*Host) ([]*Host, []*Host) {
+    current := make(map[string]bool)
+    for _, name := range ds.hostRefresher() {
+        current[name] = true
+    }
+
+    known := make(map[string]bool, len(ds.HOSTS))
+    for i := range ds.HOSTS {
+        known[ds.HOSTS[i].Name] = true
+    }
+    added := make([]Host, 0)
+    for name := range current {
+        if !known[name] {
+            // no command or vars of their own, so Execute runs the default command on them
+            added = append(added, Host{Name: name, ExitCode: -1})
+            known[name] = true
+        }
+    }
+    sort.Slice(added, func(i, j int) bool { return added[i].Name < added[j].Name })
+
+    // remember positions before HOSTS moves
+    index := make(map[*Host]int, len(ds.HOSTS))
+    for i := range ds.HOSTS {
+        index[&ds.HOSTS[i]] = i
+    }
+    ds.hostsMu.Lock()
+    ds.HOSTS = append(ds.HOSTS, added...)
+    ds.hostsMu.Unlock()
+    remap := func(list []*Host) []*Host {
+        out := make([]*Host, 0, len(list) + len(added))
+        for i := range list {
+            if n, ok := index[list[i]]; ok {
+                out = append(out, &ds.HOSTS[n])
+            } else {
+                out = append(out, list[i])
+            }
+        }
+        return out
+    }
+    hosts = remap(hosts)
+    retry := make([]*Host, 0, len(pending) + len(added))
+    for _, h := range remap(pending) {
+        if current[h.Name] {
+            retry = append(retry, h)
+            continue
+        }
+        h.SkipReason = SkipGone
+        h.setStatus(Skipped)
+        if ds.monitor {
+            fmt.Fprintf(ds.output(), "INFO: host %s is gone, not retrying\n", h.Name)
+        }
+    }
+    for i := len(ds.HOSTS) - len(added); i < len(ds.HOSTS); i++ {
+        hosts = append(hosts, &ds.HOSTS[i])
+        retry = append(retry, &ds.HOSTS[i])
+    }
+    return hosts, retry
+}
+
+// hostFailed reports whether the host counts as failed, connection errors are forgiven by SetIgnoreConnectErrors
+func (ds *DistShell) hostFailed(h *Host) bool {
+    if h.CmdError == nil || h.SkipReason == SkipGone {
+        return false
+    }
+    return !(ds.ignoreConnectErrors && h.ExitCode == connectErrorExitCode)
+}
+
+// InFlight returns the sorted names of hosts whose work has started but not finished
+// It is safe to call from another go routine while a run is in progress and is empty once the run returns
+func (ds *DistShell) InFlight() []string {
+    ds.inflightMu.Lock()
+    defer ds.inflightMu.Unlock()
+    names := make([]string, 0, len(ds.inflight))
+    for name := range ds.inflight {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// startInFlight marks a host as running
+func (ds *DistShell) startInFlight(name string, cancel context.CancelFunc) {
+    ds.inflightMu.Lock()
+    defer ds.inflightMu.Unlock()
+    if ds.inflight == nil {
+        ds.inflight = make(map[string]int)
+        ds.hostCancels = make(map[string]context.CancelFunc)
+    }
+    ds.inflight[name] += 1
+    ds.hostCancels[name] = cancel
+}
+
+// finishInFlight marks a host as done
+func (ds *DistShell) finishInFlight(name string) {
+    ds.inflightMu.Lock()
+    defer ds.inflightMu.Unlock()
+    ds.inflight[name] -= 1
+    if ds.inflight[name] <= 0 {
+        delete(ds.inflight, name)
+        delete(ds.hostCancels, name)
+    }
+}
+
+// checkFailures records the hosts whose command failed and returns them as a comma delimited error
+func (ds *DistShell) checkFailures(hosts []*Host) error {
+    ds.failedHosts = make([]string, 0)
+    for i := range hosts {
+        if ds.hostFailed(hosts[i]) {
+            ds.failedHosts = append(ds.failedHosts, hosts[i].Name)
+        }
+    }
+    if ds.sortFailedHosts {
+        sort.Strings(ds.failedHosts)
+    }
+    if len(ds.failedHosts) > 0 {
+        return errors.New(strings.Join(ds.failedHosts, ","))
+    }
+    return nil
+}
+
+// SetSortFailedHosts sorts the failed hosts named in a run's error and returned by LastFailedHosts alphabetically,
+// so the same set of failures always produces the same string.  Default is false, keeping host order
+func (ds *DistShell) SetSortFailedHosts(enable bool) {
+    ds.sortFailedHosts = enable
+}
+
+// LastFailedHosts returns the hosts that failed during the most recent run
+func (ds *DistShell) LastFailedHosts() []string {
+    failed := make([]string, len(ds.failedHosts))
+    copy(failed, ds.failedHosts)
+    return failed
+}
+
+// ConnectionFailedHosts returns the hosts of the most recent run that failed with ssh's connection error status (255)
+// Like SetIgnoreConnectErrors it cannot tell them apart from a remote command that itself exits 255
+func (ds *DistShell) ConnectionFailedHosts() []string {
+    names := make([]string, 0)
+    for i := range ds.results {
+        if ds.results[i].Error != nil && ds.results[i].ExitCode == connectErrorExitCode {
+            names = append(names, ds.results[i].Name)
+        }
+    }
+    return names
+}
+
+// RetryConnectionFailures runs the hosts' commands again on ConnectionFailedHosts only, leaving hosts that succeeded or
+// whose command failed alone.  The results of the retry replace those of the previous run.  Nothing runs if no host
+// failed to connect
+func (ds *DistShell) RetryConnectionFailures(ctx context.Context) error {
+    failed := make(map[string]bool)
+    for _, name := range ds.ConnectionFailedHosts() {
+        failed[name] = true
+    }
+    if len(failed) == 0 {
+        return nil
+    }
+    hosts := make([]*Host, 0, len(failed))
+    for i := range ds.HOSTS {
+        if failed[ds.HOSTS[i].Name] {
+            hosts = append(hosts, &ds.HOSTS[i])
+        }
+    }
+    return ds.execute(ctx, hosts)
+}
+
+// resetHosts clears the results of a previous run so failures are reported per run
+func resetHosts(hosts []*Host) {
+    for i := range hosts {
+        hosts[i].CmdError = nil
+        hosts[i].Stdout = nil
+        hosts[i].Stderr = nil
+        hosts[i].StepResults = nil
+        hosts[i].RemotePID = 0
+        hosts[i].OutputBytes = 0
+        hosts[i].SkipReason = ""
+        hosts[i].Attempts = 0
+        hosts[i].ExitCode = -1
+        hosts[i].Signal = 0
+        hosts[i].JSON = nil
+        hosts[i].JSONErrors = nil
+        hosts[i].ConnectDuration = 0
+        hosts[i].OutputChecksum = ""
+        hosts[i].setStatus(Pending)
+        hosts[i].StartedAt = time.Time{}
+        hosts[i].FinishedAt = time.Time{}
+    }
+}
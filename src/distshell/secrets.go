@@ -0,0 +1,31 @@
+package distshell
+
+import (
+    "regexp"
+)
+
+// secretMask replaces secrets in command lines and messages
+const secretMask = "****"
+
+// SetSecretPatterns replaces the patterns whose matches are masked as **** wherever distshell shows a command line or
+// a status message: monitor output, the approval prompt, overwrite warnings, StepResults, staged previews and status
+// events.  Commands are still sent to the hosts unmasked and command output is never masked
+func (ds *DistShell) SetSecretPatterns(patterns []*regexp.Regexp) {
+    ds.secrets = patterns
+}
+
+// AddSecret masks every occurrence of the literal string s, such as a token passed as an argument
+func (ds *DistShell) AddSecret(s string) {
+    if s == "" {
+        return
+    }
+    ds.secrets = append(ds.secrets, regexp.MustCompile(regexp.QuoteMeta(s)))
+}
+
+// mask replaces every secret in s
+func (ds *DistShell) mask(s string) string {
+    for _, re := range ds.secrets {
+        s = re.ReplaceAllString(s, secretMask)
+    }
+    return s
+}
@@ -0,0 +1,65 @@
+package distshell
+
+import (
+    "context"
+    "fmt"
+)
+
+// StagedRun collects command assignments apart from the DistShell so they can be previewed and changed
+// before anything is applied.  Only the hosts staged when Commit is called are run
+type StagedRun struct {
+    ds *DistShell
+    commands map[string][]string // host name to command followed by its args
+}
+
+// Staged returns an empty StagedRun for the DistShell
+func (ds *DistShell) Staged() *StagedRun {
+    return &StagedRun{ds: ds, commands: make(map[string][]string)}
+}
+
+// Add stages command for the host, replacing anything staged for it before
+// It returns false if the host is unknown or the command is not allowed
+func (s *StagedRun) Add(h string, command string, args ...string) bool {
+    if !s.ds.commandAllowed(command) {
+        return false
+    }
+    for i := range s.ds.HOSTS {
+        if s.ds.HOSTS[i].Name == h {
+            s.commands[h] = append([]string{command}, args...)
+            return true
+        }
+    }
+    return false
+}
+
+// Remove drops the host from the staged run and reports whether it was staged
+func (s *StagedRun) Remove(h string) bool {
+    _, ok := s.commands[h]
+    delete(s.commands, h)
+    return ok
+}
+
+// Preview returns the staged command lines as "host: command args", in host list order
+func (s *StagedRun) Preview() []string {
+    lines := make([]string, 0, len(s.commands))
+    for i := range s.ds.HOSTS {
+        if command, ok := s.commands[s.ds.HOSTS[i].Name]; ok {
+            lines = append(lines, fmt.Sprintf("%s: %s", s.ds.HOSTS[i].Name, s.ds.mask(joinCommand(command[0], command[1:]))))
+        }
+    }
+    return lines
+}
+
+// Commit assigns the staged commands and runs them on the staged hosts only, as ExecuteContext does
+func (s *StagedRun) Commit(ctx context.Context) error {
+    return s.ds.claimRun(ctx, func(ctx context.Context) error {
+        hosts := make([]*Host, 0, len(s.commands))
+        for i := range s.ds.HOSTS {
+            if command, ok := s.commands[s.ds.HOSTS[i].Name]; ok {
+                s.ds.assignCommand(&s.ds.HOSTS[i], command[0], command[1:])
+                hosts = append(hosts, &s.ds.HOSTS[i])
+            }
+        }
+        return s.ds.execute(ctx, hosts)
+    })
+}
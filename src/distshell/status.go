@@ -0,0 +1,110 @@
+package distshell
+
+import (
+    "context"
+    "errors"
+    "sync/atomic"
+    "time"
+)
+
+// HostStatus is where a host is in the lifecycle of a run
+type HostStatus int32
+
+const (
+    Pending HostStatus = iota // not started yet, or never run
+    Running
+    Succeeded
+    Failed
+    TimedOut // the host's command ran out of time, see SetCommandTimeout and SetOverallTimeout
+    Skipped // the host never started, see Host.SkipReason
+)
+
+// String returns the lower case name of the status
+func (s HostStatus) String() string {
+    switch s {
+    case Pending:
+        return "pending"
+    case Running:
+        return "running"
+    case Succeeded:
+        return "succeeded"
+    case Failed:
+        return "failed"
+    case TimedOut:
+        return "timed out"
+    case Skipped:
+        return "skipped"
+    }
+    return "unknown"
+}
+
+// GetHostStatus returns the status of the named host, it is safe to call while a run is in progress
+// An unknown host is reported as Pending
+func (ds *DistShell) GetHostStatus(h string) HostStatus {
+    // SetHostRefresher may grow HOSTS between retry rounds
+    ds.hostsMu.RLock()
+    defer ds.hostsMu.RUnlock()
+    for i := range ds.HOSTS {
+        if ds.HOSTS[i].Name == h {
+            return ds.HOSTS[i].getStatus()
+        }
+    }
+    return Pending
+}
+
+// getStatus loads the host's status
+func (h *Host) getStatus() HostStatus {
+    return HostStatus(atomic.LoadInt32(&h.status))
+}
+
+// setStatus stores the host's status
+func (h *Host) setStatus(s HostStatus) {
+    atomic.StoreInt32(&h.status, int32(s))
+}
+
+// finishStatus sets the status of a host whose work has returned from its error
+func (h *Host) finishStatus() {
+    switch {
+    case h.CmdError == nil:
+        h.setStatus(Succeeded)
+    case errors.Is(h.CmdError, context.DeadlineExceeded):
+        h.setStatus(TimedOut)
+    default:
+        h.setStatus(Failed)
+    }
+}
+
+// StatusEvent describes a host changing status during a run
+type StatusEvent struct {
+    Host string
+    Status HostStatus
+    Message string // the monitoring line for the change
+    Attempt int
+    Time time.Time
+}
+
+// SetStatusCallback sets a function called each time a host starts, finishes or is skipped
+// It is called from the host's go routine so calls for different hosts can run concurrently
+func (ds *DistShell) SetStatusCallback(fn func(e StatusEvent)) {
+    if fn == nil {
+        ds.statusCallback = nil
+        return
+    }
+    ds.statusCallback = func(ctx context.Context, e StatusEvent) {
+        fn(e)
+    }
+}
+
+// SetStatusCallbackCtx is SetStatusCallback with the context the run was started with, such as the one given to
+// ExecuteContext, so request scoped values like trace spans are available in fn
+func (ds *DistShell) SetStatusCallbackCtx(fn func(ctx context.Context, e StatusEvent)) {
+    ds.statusCallback = fn
+}
+
+// emitStatus sends the host's current status to the status callback
+func (ds *DistShell) emitStatus(ctx context.Context, h *Host, msg string) {
+    if ds.statusCallback == nil {
+        return
+    }
+    ds.statusCallback(ctx, StatusEvent{Host: h.Name, Status: h.getStatus(), Message: ds.mask(msg), Attempt: h.Attempts, Time: time.Now()})
+}
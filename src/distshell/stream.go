@@ -0,0 +1,131 @@
+package distshell
+
+import (
+    "context"
+)
+
+/*
+ *   ExecuteChan runs the hosts' commands like Execute and sends each host's result as soon as it is final, in
+ *   completion order.  A failed host is sent once it will not be retried.
+ *   The channel holds SetResultBufferSize results, once it is full the run waits for the reader before starting
+ *   the next batch, so a slow reader throttles execution and at most the buffer plus one batch of results are held.
+ *   The reader must drain the channel until it is closed or cancel ctx, results not yet sent when ctx is cancelled
+ *   are dropped.  A run that cannot start closes the channel without sending anything.
+ *   The run's error, as Execute would return it, is sent on the second channel once the results channel is closed
+ */
+func (ds *DistShell) ExecuteChan() (<-chan HostResult, <-chan error) {
+    return ds.ExecuteChanContext(context.Background())
+}
+
+// ExecuteChanContext is ExecuteChan bound to ctx
+func (ds *DistShell) ExecuteChanContext(ctx context.Context) (<-chan HostResult, <-chan error) {
+    hosts := ds.allHosts()
+    ch := make(chan HostResult, ds.resultBufferSize)
+    errc := make(chan error, 1)
+    send := func(r HostResult) {
+        select {
+        case ch <- r:
+        case <-ctx.Done():
+        }
+    }
+    sent := make(map[string]bool, len(hosts))
+    started := false
+    done := func(h *Host, final bool) {
+        started = true
+        if final && !sent[h.Name] {
+            sent[h.Name] = true
+            // blocking here holds up the scheduler, which is what throttles the run
+            send(h.result())
+        }
+    }
+
+    go func() {
+        // the error is buffered before the results channel closes so it is ready once the reader is done
+        var err error
+        defer close(ch)
+        defer func() { errc <- err }()
+        err = ds.execute(context.WithValue(ctx, hostDoneKey{}, hostDoneFunc(done)), hosts)
+        if !started {
+            return
+        }
+        // failed hosts that were left with retries when the run ended early
+        for _, r := range ds.Results() {
+            if !sent[r.Name] {
+                sent[r.Name] = true
+                send(r)
+            }
+        }
+    }()
+    return ch, errc
+}
+
+// SetResultBufferSize sets how many results ExecuteChan holds for a reader that falls behind before it
+// slows the run down.  Default is 0, each batch waits for the reader
+func (ds *DistShell) SetResultBufferSize(n int) {
+    if n < 0 {
+        n = 0
+    }
+    ds.resultBufferSize = n
+}
+
+/*
+ *   ExecuteOrderedChan runs the hosts' commands like Execute and sends each host's result in host list order as soon
+ *   as it and every host before it are done, holding back results that finish early.  Batching and retries apply as
+ *   usual, a failed host is sent once it will not be retried.  Hosts added by SetHostRefresher follow the original list.
+ *   The channel is closed when the run returns, a run that cannot start, such as one refused with ErrAlreadyRunning,
+ *   closes it without sending anything.  The run's error is sent on the second channel as with ExecuteChan
+ */
+func (ds *DistShell) ExecuteOrderedChan() (<-chan HostResult, <-chan error) {
+    return ds.ExecuteOrderedChanContext(context.Background())
+}
+
+// ExecuteOrderedChanContext is ExecuteOrderedChan bound to ctx
+func (ds *DistShell) ExecuteOrderedChanContext(ctx context.Context) (<-chan HostResult, <-chan error) {
+    hosts := ds.allHosts()
+    // the buffer holds every result so a slow reader never stalls the run
+    ch := make(chan HostResult, len(hosts))
+    errc := make(chan error, 1)
+    order := make(map[string]int, len(hosts))
+    for i := len(hosts) - 1; i >= 0; i-- {
+        order[hosts[i].Name] = i
+    }
+    ready := make([]*HostResult, len(hosts))
+    next := 0
+    started := false
+    done := func(h *Host, final bool) {
+        started = true
+        i, ok := order[h.Name]
+        if !ok || !final || ready[i] != nil {
+            return
+        }
+        r := h.result()
+        ready[i] = &r
+        for next < len(ready) && ready[next] != nil {
+            ch <- *ready[next]
+            next += 1
+        }
+    }
+
+    go func() {
+        var err error
+        defer close(ch)
+        defer func() { errc <- err }()
+        err = ds.execute(context.WithValue(ctx, hostDoneKey{}, hostDoneFunc(done)), hosts)
+        if !started {
+            // the run was refused, Results still belong to the previous run
+            return
+        }
+        // hosts still held back when the run ended early, and any added during it, in the order they were recorded
+        sent := make(map[string]bool, next)
+        for i := 0; i < next; i++ {
+            sent[ready[i].Name] = true
+        }
+        for _, r := range ds.Results() {
+            if !sent[r.Name] {
+                sent[r.Name] = true
+                ch <- r
+            }
+        }
+    }()
+    return ch, errc
+}
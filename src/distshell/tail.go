@@ -0,0 +1,62 @@
+package distshell
+
+import (
+    "bufio"
+    "context"
+    "io"
+    "sync"
+    "time"
+)
+
+// tailWaitDelay is how long a cancelled tail may take to release its output before the pipe is closed
+const tailWaitDelay = 2 * time.Second
+
+// Tail runs tail -f on remotePath on every host and passes each new line to onLine until stop is called
+// All hosts are followed at once regardless of maxBatch, and onLine is called concurrently from one go routine per host
+// stop cancels the remote tails and waits for them to exit
+func (ds *DistShell) Tail(remotePath string, onLine func(host, line string)) (stop func(), err error) {
+    SSH, err := lookPath("ssh")
+    if err != nil {
+        return nil, err
+    }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    var wg sync.WaitGroup
+    var once sync.Once
+    stop = func() {
+        once.Do(func() {
+            cancel()
+            wg.Wait()
+        })
+    }
+
+    for i := range ds.HOSTS {
+        cmdArgs := append(ds.sshArgs(&ds.HOSTS[i]), "tail", "-f", shellQuote(remotePath))
+        c := execCommandContext(ctx, SSH, cmdArgs...)
+        // close the pipes shortly after cancellation even if a remote child still holds them
+        c.WaitDelay = tailWaitDelay
+        pr, pw := io.Pipe()
+        c.Stdout = pw
+        if err := c.Start(); err != nil {
+            stop()
+            return nil, err
+        }
+
+        wg.Add(2)
+        go func() {
+            defer wg.Done()
+            c.Wait()
+            pw.Close()
+        }()
+        go func(name string) {
+            defer wg.Done()
+            scanner := bufio.NewScanner(pr)
+            for scanner.Scan() {
+                onLine(name, scanner.Text())
+            }
+            // keep draining so the copy into pw never blocks Wait
+            io.Copy(io.Discard, pr)
+        }(ds.HOSTS[i].Name)
+    }
+    return stop, nil
+}
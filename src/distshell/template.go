@@ -0,0 +1,74 @@
+package distshell
+
+import (
+    "bytes"
+    "strings"
+    "text/template"
+)
+
+// templateData is the value commands and args are executed against, e.g. {{.Name}}, {{.Vars.version}} or {{.Meta.role}}
+type templateData struct {
+    Name string
+    Vars map[string]string
+    Meta map[string]string
+}
+
+// SetTemplating renders every host's command and args as text/template templates, e.g. {{.Name}} or {{.Meta.role}}.
+// Default is false so commands that contain {{ themselves, such as docker ps --format '{{.Names}}', are sent as given.
+// Hosts given vars with SetHostVars are always rendered
+func (ds *DistShell) SetTemplating(enable bool) {
+    ds.templating = enable
+}
+
+// SetHostVars sets the variables available to command templates for the given host as {{.Vars.key}}
+// Setting vars turns on templating for that host, see SetTemplating
+func (ds *DistShell) SetHostVars(h string, vars map[string]string) bool {
+    for i := range ds.HOSTS {
+        if ds.HOSTS[i].Name == h {
+            ds.HOSTS[i].vars = vars
+            return true
+        }
+    }
+    return false
+}
+
+// expandCommand renders any templates in the command and args for the given host
+// Referencing a variable the host does not have is an error rather than an empty substitution
+func expandCommand(h *Host, command string, args []string) (string, []string, error) {
+    data := templateData{Name: h.Name, Vars: h.vars, Meta: h.Meta}
+    if data.Vars == nil {
+        data.Vars = map[string]string{}
+    }
+    if data.Meta == nil {
+        data.Meta = map[string]string{}
+    }
+
+    expanded, err := expandTemplate(command, data)
+    if err != nil {
+        return "", nil, err
+    }
+    expandedArgs := make([]string, len(args))
+    for i := range args {
+        expandedArgs[i], err = expandTemplate(args[i], data)
+        if err != nil {
+            return "", nil, err
+        }
+    }
+    return expanded, expandedArgs, nil
+}
+
+// expandTemplate renders a single string, leaving strings without template actions untouched
+func expandTemplate(s string, data templateData) (string, error) {
+    if !strings.Contains(s, "{{") {
+        return s, nil
+    }
+    t, err := template.New("cmd").Option("missingkey=error").Parse(s)
+    if err != nil {
+        return "", err
+    }
+    var buf bytes.Buffer
+    if err := t.Execute(&buf, data); err != nil {
+        return "", err
+    }
+    return buf.String(), nil
+}
@@ -0,0 +1,504 @@
+package distshell
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "io"
+    "fmt"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+// cleanupTimeout bounds the ssh call that removes the temporary file of a failed or cancelled upload
+const cleanupTimeout = 30 * time.Second
+
+/*
+ *   GetFile will download a given file from remote node into specified dir
+ *   filestring = /path/to/file
+ *   destination = /path/to/destination/[dir|file]
+ */
+func (ds *DistShell) GetFile(filestring string, destination string) error {
+    return ds.GetFileContext(context.Background(), filestring, destination)
+}
+
+// GetFileContext is GetFile bound to ctx
+// Cancelling ctx stops in flight transfers.  Each host downloads into its own temporary directory next to the
+// destination and the file is renamed into place only once its transfer succeeds, so a failed host never touches
+// the file another host wrote.  With several hosts the last successful transfer wins
+func (ds *DistShell) GetFileContext(ctx context.Context, filestring string, destination string) error {
+    tool, useSFTP := ds.transferTool()
+    localFile := localDestination(filestring, destination)
+
+    return ds.runBatch(ctx, ds.allHosts(), func(ctx context.Context, hostname *Host) string {
+        tmpDir, err := os.MkdirTemp(filepath.Dir(localFile), ".distshell-get-")
+        if err != nil {
+            hostname.CmdError = err
+            return fmt.Sprintf("%s: ERROR %s", hostname.Name, err)
+        }
+        defer os.RemoveAll(tmpDir)
+        tmpFile := filepath.Join(tmpDir, filepath.Base(localFile))
+
+        var cmdout []byte
+        var cmderr error
+        if useSFTP {
+            cmdout, cmderr = ds.runSFTP(ctx, hostname, tool, "get " + sftpQuote(filestring) + " " + sftpQuote(tmpFile))
+        } else {
+            remoteFile := ds.target(hostname.Name) + ":" + filestring
+            scpArgs := append(ds.scpArgs(), remoteFile, tmpFile)
+            cmdout, cmderr = ds.runSCP(ctx, hostname, tool, scpArgs)
+        }
+        if cmderr == nil {
+            cmderr = os.Rename(tmpFile, localFile)
+        }
+        if cmderr != nil {
+            // a truncated download stays in tmpDir, which is removed
+            hostname.CmdError = cmderr
+            return fmt.Sprintf("%s: ERROR %s: %s", hostname.Name, cmdout, cmderr)
+        }
+        return fmt.Sprintf("%s: SUCCESS", hostname.Name)
+    })
+}
+
+/*
+ *   GetFiles will download several files from every remote node with one transfer per node
+ *   files = /path/to/file1, /path/to/file2
+ *   destination = /path/to/destination/dir, each node's files are written to destination/<host>/
+ */
+func (ds *DistShell) GetFiles(files []string, destination string) error {
+    return ds.GetFilesContext(context.Background(), files, destination)
+}
+
+// GetFilesContext is GetFiles bound to ctx
+func (ds *DistShell) GetFilesContext(ctx context.Context, files []string, destination string) error {
+    if len(files) == 0 {
+        return errors.New("no files to get")
+    }
+    if info, err := os.Stat(destination); err != nil || !info.IsDir() {
+        return fmt.Errorf("destination %s must be an existing directory", destination)
+    }
+    tool, useSFTP := ds.transferTool()
+
+    return ds.runBatch(ctx, ds.allHosts(), func(ctx context.Context, hostname *Host) string {
+        hostDir := filepath.Join(destination, hostname.Name)
+        if err := os.MkdirAll(hostDir, 0755); err != nil {
+            hostname.CmdError = err
+            return fmt.Sprintf("%s: ERROR %s", hostname.Name, err)
+        }
+        localFiles := make([]string, len(files))
+        before := make([]os.FileInfo, len(files))
+        statErrs := make([]error, len(files))
+        for i := range files {
+            localFiles[i] = filepath.Join(hostDir, path.Base(files[i]))
+            before[i], statErrs[i] = os.Stat(localFiles[i])
+        }
+
+        var cmdout []byte
+        var cmderr error
+        if useSFTP {
+            batch := make([]string, len(files))
+            for i := range files {
+                batch[i] = "get " + sftpQuote(files[i]) + " " + sftpQuote(hostDir)
+            }
+            cmdout, cmderr = ds.runSFTP(ctx, hostname, tool, strings.Join(batch, "\n"))
+        } else {
+            scpArgs := ds.scpArgs()
+            for i := range files {
+                scpArgs = append(scpArgs, ds.target(hostname.Name) + ":" + files[i])
+            }
+            scpArgs = append(scpArgs, hostDir)
+            cmdout, cmderr = ds.runSCP(ctx, hostname, tool, scpArgs)
+        }
+        if cmderr != nil {
+            hostname.CmdError = cmderr
+            for i := range localFiles {
+                removePartialFile(localFiles[i], before[i], statErrs[i])
+            }
+            // only succeeds if the directory was left empty
+            os.Remove(hostDir)
+            return fmt.Sprintf("%s: ERROR %s: %s", hostname.Name, cmdout, cmderr)
+        }
+        return fmt.Sprintf("%s: SUCCESS", hostname.Name)
+    })
+}
+
+/*
+ *   PutFile will upload a given local file to every remote node
+ *   filestring = /path/to/local/file
+ *   destination = /path/to/remote/destination/[dir|file]
+ */
+func (ds *DistShell) PutFile(filestring string, destination string) error {
+    return ds.PutFileContext(context.Background(), filestring, destination)
+}
+
+// PutFileContext is PutFile bound to ctx
+// Each host uploads to a temporary file next to the destination which is moved into place once the transfer
+// succeeds, so a file already at the destination is only replaced by a complete upload.  The moved file keeps the
+// mode scp or sftp created it with.  Cancelling ctx stops in flight transfers and removes their temporary files
+func (ds *DistShell) PutFileContext(ctx context.Context, filestring string, destination string) error {
+    tool, useSFTP := ds.transferTool()
+
+    return ds.runBatch(ctx, ds.allHosts(), func(ctx context.Context, hostname *Host) string {
+        return ds.putFile(ctx, hostname, tool, useSFTP, filestring, destination)
+    })
+}
+
+/*
+ *   PutFileMap will upload a given local file to a different destination on each remote node
+ *   localPath = /path/to/local/file
+ *   destByHost = host name to /path/to/remote/destination/[dir|file], hosts missing from the map are left alone
+ */
+func (ds *DistShell) PutFileMap(localPath string, destByHost map[string]string) error {
+    return ds.PutFileMapContext(context.Background(), localPath, destByHost)
+}
+
+// PutFileMapContext is PutFileMap bound to ctx
+func (ds *DistShell) PutFileMapContext(ctx context.Context, localPath string, destByHost map[string]string) error {
+    hosts := make([]*Host, 0, len(destByHost))
+    for i := range ds.HOSTS {
+        if _, ok := destByHost[ds.HOSTS[i].Name]; ok {
+            hosts = append(hosts, &ds.HOSTS[i])
+        }
+    }
+    tool, useSFTP := ds.transferTool()
+
+    return ds.runBatch(ctx, hosts, func(ctx context.Context, hostname *Host) string {
+        return ds.putFile(ctx, hostname, tool, useSFTP, localPath, destByHost[hostname.Name])
+    })
+}
+
+// putFile uploads filestring to a temporary file on one host and moves it to destination
+func (ds *DistShell) putFile(ctx context.Context, hostname *Host, tool string, useSFTP bool, filestring string, destination string) string {
+    base := path.Base(filestring)
+    tmpFile := remoteTempPath(destination, base)
+    var cmdout []byte
+    var cmderr error
+    if useSFTP {
+        cmdout, cmderr = ds.runSFTP(ctx, hostname, tool, "put " + sftpQuote(filestring) + " " + sftpQuote(tmpFile))
+    } else {
+        remoteFile := ds.target(hostname.Name) + ":" + tmpFile
+        scpArgs := append(ds.scpArgs(), filestring, remoteFile)
+        cmdout, cmderr = ds.runSCP(ctx, hostname, tool, scpArgs)
+    }
+    if cmderr == nil {
+        dest, tmp := shellQuote(destination), shellQuote(tmpFile)
+        script := fmt.Sprintf("if [ -d %s ]; then mv -f %s %s; else mv -f %s %s; fi",
+            dest, tmp, shellQuote(strings.TrimRight(destination, "/") + "/" + base), tmp, dest)
+        cmdout, cmderr = ds.runRemoteScript(ctx, hostname, script)
+    }
+    if cmderr != nil {
+        hostname.CmdError = cmderr
+        // only the temporary file is removed, whatever was at destination is left alone
+        ds.removeRemoteFile(hostname, tmpFile)
+        return fmt.Sprintf("%s: ERROR %s: %s", hostname.Name, cmdout, cmderr)
+    }
+    return fmt.Sprintf("%s: SUCCESS", hostname.Name)
+}
+
+// remoteTempPath returns a temporary file name for an upload of base to destination, in the directory the
+// destination is in, or in the destination itself when it ends in a slash
+func remoteTempPath(destination string, base string) string {
+    dir := path.Dir(destination)
+    if strings.HasSuffix(destination, "/") {
+        dir = destination
+    }
+    return path.Join(dir, fmt.Sprintf(".distshell-put-%d-%s", time.Now().UnixNano(), base))
+}
+
+// runRemoteScript runs a shell script on the given host over ssh
+func (ds *DistShell) runRemoteScript(ctx context.Context, h *Host, script string) ([]byte, error) {
+    SSH, lookupErr := lookPath("ssh")
+    if lookupErr != nil {
+        return nil, fmt.Errorf("unable to find ssh in $PATH: %s", lookupErr)
+    }
+    out, err := execCommandContext(ctx, SSH, append(ds.sshArgs(h), script)...).CombinedOutput()
+    if err != nil {
+        return out, errors.New("Failed to execute '" + script + "' on host " + h.Name + ": " + err.Error())
+    }
+    return out, nil
+}
+
+// lookupSCP finds scp in $PATH and exits if it is missing
+func lookupSCP() string {
+    SCP, lookupErr := lookPath("scp")
+    if lookupErr != nil {
+        fmt.Printf("Unable to find scp in $PATH\n")
+        os.Exit(1)
+    }
+    return SCP
+}
+
+// SetUseSFTP makes GetFile and PutFile use sftp in batch mode instead of scp, for hosts that disable the scp protocol
+// If sftp is not in $PATH a warning is written to the output and scp is used
+func (ds *DistShell) SetUseSFTP(use bool) {
+    ds.useSFTP = use
+}
+
+// transferTool returns the path of the binary used for file transfers and whether it is sftp
+func (ds *DistShell) transferTool() (string, bool) {
+    if ds.useSFTP {
+        if SFTP, err := lookPath("sftp"); err == nil {
+            return SFTP, true
+        }
+        fmt.Fprintln(ds.output(), "WARN: unable to find sftp in $PATH, falling back to scp")
+    }
+    return lookupSCP(), false
+}
+
+// runSFTP runs a single sftp batch command such as "get a b" against the host, batch mode makes any failure fatal
+func (ds *DistShell) runSFTP(ctx context.Context, h *Host, SFTP string, batch string) ([]byte, error) {
+    args := []string{"-b", "-"}
+    if ds.scpQuiet {
+        args = append(args, "-q")
+    }
+    args = append(args, ds.sshOptions()...)
+    args = append(args, ds.target(h.Name))
+    c := execCommandContext(ctx, SFTP, args...)
+    c.Stdin = strings.NewReader(batch + "\n")
+    out, err := c.CombinedOutput()
+    if err != nil {
+        return out, errors.New("Failed to execute sftp command '" + batch + "' on host " + h.Name + ": " + err.Error())
+    }
+    return out, nil
+}
+
+// sftpQuote quotes a path for an sftp batch file
+func sftpQuote(s string) string {
+    return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+// scpArgs returns the options passed to every scp invocation
+func (ds *DistShell) scpArgs() []string {
+    if ds.scpQuiet {
+        return append([]string{"-q"}, ds.sshOptions()...)
+    }
+    return ds.sshOptions()
+}
+
+// SetSCPQuiet passes -q to scp so its warnings and diagnostics stay out of transfer errors.  Default is true
+func (ds *DistShell) SetSCPQuiet(quiet bool) {
+    ds.scpQuiet = quiet
+}
+
+// SetTransferStderr sets a function called with each line scp writes to stderr, such as warnings about host keys
+// or permissions, while GetFile and PutFile run.  scp only draws its progress meter on a terminal so no progress
+// is reported.  It is only called when SetSCPQuiet is off and may be called from several go routines
+func (ds *DistShell) SetTransferStderr(fn func(host string, line string)) {
+    ds.transferStderr = fn
+}
+
+// runSCP runs scp for one host, feeding its stderr to the transfer stderr function when one is set
+func (ds *DistShell) runSCP(ctx context.Context, h *Host, SCP string, args []string) ([]byte, error) {
+    if ds.scpQuiet || ds.transferStderr == nil {
+        return runCMDContext(ctx, SCP, args...)
+    }
+    var out bytes.Buffer
+    lines := &lineWriter{fn: func(line string) { ds.transferStderr(h.Name, line) }}
+    c := execCommandContext(ctx, SCP, args...)
+    c.Stdout = &out
+    c.Stderr = io.MultiWriter(&out, lines)
+    err := c.Run()
+    lines.flush()
+    if err != nil {
+        return out.Bytes(), errors.New("Failed to execute command '" + joinCommand(SCP, args) + "': " + err.Error())
+    }
+    return out.Bytes(), nil
+}
+
+// lineWriter calls fn for every non empty line written to it, \r ends a line too
+type lineWriter struct {
+    fn func(line string)
+    buf []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+    w.buf = append(w.buf, p...)
+    for {
+        i := bytes.IndexAny(w.buf, "\r\n")
+        if i < 0 {
+            break
+        }
+        if line := strings.TrimSpace(string(w.buf[:i])); line != "" {
+            w.fn(line)
+        }
+        w.buf = w.buf[i+1:]
+    }
+    return len(p), nil
+}
+
+// flush sends any trailing partial line
+func (w *lineWriter) flush() {
+    if line := strings.TrimSpace(string(w.buf)); line != "" {
+        w.fn(line)
+    }
+    w.buf = nil
+}
+
+// localDestination returns the local file scp writes to when copying filestring to destination
+func localDestination(filestring string, destination string) string {
+    if info, err := os.Stat(destination); err == nil && info.IsDir() {
+        return filepath.Join(destination, path.Base(filestring))
+    }
+    return destination
+}
+
+// removePartialFile removes localFile if it was created or modified since before was taken
+func removePartialFile(localFile string, before os.FileInfo, beforeErr error) {
+    after, err := os.Stat(localFile)
+    if err != nil || after.IsDir() {
+        return
+    }
+    if beforeErr != nil || !after.ModTime().Equal(before.ModTime()) || after.Size() != before.Size() {
+        os.Remove(localFile)
+    }
+}
+
+// removeRemoteFile removes file from the given host, on its own context since the upload's may be cancelled
+func (ds *DistShell) removeRemoteFile(h *Host, file string) {
+    ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+    defer cancel()
+    ds.runRemoteScript(ctx, h, "rm -f " + shellQuote(file))
+}
+
+// shellQuote quotes s so the remote shell treats it as a single word
+func shellQuote(s string) string {
+    return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+/*
+ *   GetFileSince downloads the bytes of remotePath each host has written since the offset recorded for it
+ *   offsetByHost = offsets returned by the previous call, hosts missing from it start at 0
+ *   destination = /path/to/destination/dir, new bytes are appended to destination/<host>/<file>
+ *   It returns the offset to pass next time for every host.  A host whose file is now shorter than its offset was
+ *   rotated and is read again from the start.  A failed host keeps its previous offset and its local file is left
+ *   as it was
+ */
+func (ds *DistShell) GetFileSince(remotePath string, offsetByHost map[string]int64, destination string) (map[string]int64, error) {
+    return ds.GetFileSinceContext(context.Background(), remotePath, offsetByHost, destination)
+}
+
+// GetFileSinceContext is GetFileSince bound to ctx
+func (ds *DistShell) GetFileSinceContext(ctx context.Context, remotePath string, offsetByHost map[string]int64, destination string) (map[string]int64, error) {
+    if info, err := os.Stat(destination); err != nil || !info.IsDir() {
+        return nil, fmt.Errorf("destination %s must be an existing directory", destination)
+    }
+    SSH := ""
+    if ds.transport == nil {
+        var lookupErr error
+        SSH, lookupErr = lookPath("ssh")
+        if lookupErr != nil {
+            return nil, fmt.Errorf("unable to find ssh in $PATH: %s", lookupErr)
+        }
+    }
+
+    var mu sync.Mutex
+    offsets := make(map[string]int64, len(ds.HOSTS))
+    for i := range ds.HOSTS {
+        offsets[ds.HOSTS[i].Name] = offsetByHost[ds.HOSTS[i].Name]
+    }
+
+    err := ds.runBatch(ctx, ds.allHosts(), func(ctx context.Context, h *Host) string {
+        hostDir := filepath.Join(destination, h.Name)
+        if err := os.MkdirAll(hostDir, 0755); err != nil {
+            h.CmdError = err
+            return fmt.Sprintf("%s: ERROR %s", h.Name, err)
+        }
+        localFile := filepath.Join(hostDir, path.Base(remotePath))
+        f, err := os.OpenFile(localFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+        if err != nil {
+            h.CmdError = err
+            return fmt.Sprintf("%s: ERROR %s", h.Name, err)
+        }
+        before, _ := f.Seek(0, io.SeekEnd)
+
+        mu.Lock()
+        offset := offsets[h.Name]
+        mu.Unlock()
+        // the first line reports where reading started and the file's size, the bytes in between follow
+        script := fmt.Sprintf(`f=%s; size=$(wc -c < "$f") || exit 1; size=$((size)); start=%d; if [ "$size" -lt "$start" ]; then start=0; fi; echo "$start $size"; tail -c +$((start + 1)) "$f" | head -c $((size - start))`,
+            shellQuote(remotePath), offset)
+        out := &offsetWriter{w: f}
+        var stderr bytes.Buffer
+        if ds.transport != nil {
+            err = ds.transport.Run(ctx, ds.target(h.Name), []string{script}, out, &stderr)
+        } else {
+            // plain ssh options, a pty from SetRequestTTY would turn LF into CRLF and break the byte count
+            c := execCommandContext(ctx, SSH, append(ds.sshOptions(), ds.target(h.Name), script)...)
+            c.Stdout = out
+            c.Stderr = &stderr
+            err = c.Run()
+        }
+        if err == nil {
+            err = out.err
+        }
+        if err == nil && !out.done {
+            err = errors.New("no offset header in remote output")
+        }
+        if err == nil && out.written != out.size - out.start {
+            err = fmt.Errorf("expected %d bytes, got %d", out.size - out.start, out.written)
+        }
+        if err != nil {
+            // drop the partial append so the next call resumes cleanly
+            f.Truncate(before)
+            f.Close()
+            h.CmdError = err
+            h.Stderr = stderr.Bytes()
+            return fmt.Sprintf("%s: ERROR %s: %s", h.Name, strings.TrimSpace(stderr.String()), err)
+        }
+        if err := f.Close(); err != nil {
+            h.CmdError = err
+            return fmt.Sprintf("%s: ERROR %s", h.Name, err)
+        }
+        mu.Lock()
+        offsets[h.Name] = out.size
+        mu.Unlock()
+        if out.start < offset {
+            return fmt.Sprintf("%s: SUCCESS %d bytes, file was rotated", h.Name, out.written)
+        }
+        return fmt.Sprintf("%s: SUCCESS %d bytes", h.Name, out.written)
+    })
+    return offsets, err
+}
+
+// offsetWriter parses the "start size" header GetFileSince's remote script prints and writes the bytes after it to w
+type offsetWriter struct {
+    w io.Writer
+    header []byte
+    done bool
+    start int64
+    size int64
+    written int64
+    err error
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+    n := len(p)
+    if o.err != nil {
+        return 0, o.err
+    }
+    if !o.done {
+        i := bytes.IndexByte(p, '\n')
+        if i < 0 {
+            o.header = append(o.header, p...)
+            return n, nil
+        }
+        o.header = append(o.header, p[:i]...)
+        p = p[i+1:]
+        o.done = true
+        if _, err := fmt.Sscanf(string(o.header), "%d %d", &o.start, &o.size); err != nil {
+            o.err = fmt.Errorf("malformed offset header %q", o.header)
+            return 0, o.err
+        }
+    }
+    written, err := o.w.Write(p)
+    o.written += int64(written)
+    if err != nil {
+        o.err = err
+        return 0, err
+    }
+    return n, nil
+}
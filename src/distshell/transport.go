@@ -0,0 +1,115 @@
+package distshell
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "os/exec"
+    "strings"
+    "sync"
+)
+
+/*
+ *   Every local process distshell starts, ssh, scp, sftp and local commands alike, is created through these
+ *   variables so tests inside the package can replace them with fakes that never touch the network
+ *
+ *   execCommandContext = func(ctx context.Context, name string, args ...string) *exec.Cmd {
+ *       return exec.CommandContext(ctx, "echo", append([]string{name}, args...)...)
+ *   }
+ *   lookPath = func(file string) (string, error) { return file, nil }
+ *
+ *   Code outside the package should use SetTransport instead
+ */
+var (
+    execCommand = exec.Command
+    execCommandContext = exec.CommandContext
+    lookPath = exec.LookPath
+)
+
+// Transport runs a command on a remote host, writing its output to stdout and stderr
+// host is the connection target, which differs from the host's Name when SetHostResolver is used
+// A non zero exit status should be reported with an error that has an ExitCode() int method as *exec.ExitError does
+type Transport interface {
+    Run(ctx context.Context, host string, command []string, stdout io.Writer, stderr io.Writer) error
+}
+
+// SetTransport replaces ssh with t for running host commands, nil restores ssh.  File transfers still use scp
+func (ds *DistShell) SetTransport(t Transport) {
+    ds.transport = t
+}
+
+/*
+ *   FakeTransport is a Transport that never leaves the local process, it is the recommended way
+ *   to test code built on DistShell
+ *
+ *   fake := &distshell.FakeTransport{}
+ *   fake.Program("web1", "ok\n", 0)
+ *   fake.Program("web2", "disk full\n", 1)
+ *   ds.SetTransport(fake)
+ *
+ *   Hosts that were not programmed succeed with no output
+ */
+type FakeTransport struct {
+    mu sync.Mutex
+    programs map[string]fakeProgram
+    calls map[string][]string
+}
+
+// fakeProgram is the scripted response for one host
+type fakeProgram struct {
+    stdout string
+    exit int
+}
+
+// FakeExitError is returned by FakeTransport for a host programmed with a non zero exit status
+type FakeExitError struct {
+    Code int
+}
+
+func (e *FakeExitError) Error() string {
+    return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// ExitCode returns the programmed exit status
+func (e *FakeExitError) ExitCode() int {
+    return e.Code
+}
+
+// Program sets the output and exit status every command run on host will produce
+func (f *FakeTransport) Program(host string, stdout string, exit int) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    if f.programs == nil {
+        f.programs = make(map[string]fakeProgram)
+    }
+    f.programs[host] = fakeProgram{stdout: stdout, exit: exit}
+}
+
+// Commands returns the command lines run on host in the order they were run
+func (f *FakeTransport) Commands(host string) []string {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    cmds := make([]string, len(f.calls[host]))
+    copy(cmds, f.calls[host])
+    return cmds
+}
+
+// Run implements Transport
+func (f *FakeTransport) Run(ctx context.Context, host string, command []string, stdout io.Writer, stderr io.Writer) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    f.mu.Lock()
+    if f.calls == nil {
+        f.calls = make(map[string][]string)
+    }
+    f.calls[host] = append(f.calls[host], strings.Join(command, " "))
+    p := f.programs[host]
+    f.mu.Unlock()
+
+    io.WriteString(stdout, p.stdout)
+    if p.exit != 0 {
+        return &FakeExitError{Code: p.exit}
+    }
+    return nil
+}